@@ -0,0 +1,90 @@
+package dnsrouter
+
+import (
+	"net"
+	"strings"
+)
+
+// ACL is a list of networks used to restrict clients by source address.
+//
+// Handlers restricting clients, e.g. Transfer, Update and View, pair an ACL
+// with Keys, the names of TSIG keys. A client matches if its address is within
+// the ACL, or if the request is authenticated by Tsig with any of the keys, so
+// nobody matches if both are empty. Keys take effect only if the dns.Server is
+// configured by Tsig.Configure, without which nothing is authenticated.
+type ACL []*net.IPNet
+
+// ParseACL parses networks in CIDR notation, e.g. "192.0.2.0/24", or single IP
+// addresses, e.g. "2001:db8::1".
+func ParseACL(s ...string) (ACL, error) {
+	acl := make(ACL, 0, len(s))
+	for _, v := range s {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: v}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			acl = append(acl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, network)
+	}
+	return acl, nil
+}
+
+// Contains reports whether the ip is within any of the networks.
+func (acl ACL) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr is like Contains, but takes a network address as the one
+// returned by dns.ResponseWriter.RemoteAddr.
+func (acl ACL) ContainsAddr(addr net.Addr) bool {
+	return acl.Contains(addrIP(addr))
+}
+
+// addrIP returns the IP of the address, or nil if unknown.
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		if v != nil {
+			return v.IP
+		}
+		return nil
+	case *net.UDPAddr:
+		if v != nil {
+			return v.IP
+		}
+		return nil
+	case *net.IPAddr:
+		if v != nil {
+			return v.IP
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
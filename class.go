@@ -35,6 +35,7 @@ const (
 
 type basicClass struct {
 	value
+	name       string
 	stub       Stub
 	handler    classHandler
 	params     Params
@@ -53,7 +54,7 @@ func (c basicClass) Search(qtype uint16) Handler {
 				return ParamsHandler(h, c.params)
 			}
 		} else {
-			if qtype != dns.TypeRRSIG && qtype != dns.TypeNSEC {
+			if qtype != dns.TypeRRSIG && qtype != dns.TypeNSEC && qtype != dns.TypeNSEC3 {
 				// DNAME redirection
 				if c.node != nil && c.node.data.rrType&rrDname > 0 && c.cut {
 					h := ParamsHandler(c.handler.Search(dns.TypeDNAME), c.params)
@@ -108,7 +109,8 @@ func (c basicClass) Zone() (Class, bool) {
 }
 
 func (c basicClass) NextSecure(qtype uint16) Class {
-	if qtype == dns.TypeNSEC {
+	switch qtype {
+	case dns.TypeNSEC:
 		node := c.value.previous()
 		if node != nil && node.data != nil {
 			c.handler = node.data.handler
@@ -116,6 +118,21 @@ func (c basicClass) NextSecure(qtype uint16) Class {
 			c.searchMode = searchAny
 			return c
 		}
+	case dns.TypeNSEC3:
+		// searches the hashed name within the nearest zone of SOA
+		for i := len(c.zones) - 1; i >= 0; i-- {
+			data := c.zones[i].node.data
+			if data.rrType&rrSoa == 0 {
+				continue
+			}
+			if h := data.nsec3.search(c.name); h != nil {
+				c.handler = h
+				c.params = nil
+				c.searchMode = searchAny
+				return c
+			}
+			break
+		}
 	}
 
 	return nil
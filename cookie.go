@@ -0,0 +1,217 @@
+package dnsrouter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Lifetime of server cookies in seconds (https://tools.ietf.org/html/rfc9018#section-4.3).
+const (
+	cookieMaxAge    = 3600
+	cookieMaxFuture = 300
+)
+
+type cookieContextKeyType int
+
+// CookieContextKey is used to get whether the request presented a valid server
+// cookie from Request context, which is useful for rate limiting.
+const CookieContextKey cookieContextKeyType = 7
+
+// Cookies validates and generates DNS Cookies (https://tools.ietf.org/html/rfc7873),
+// of which server cookies are interoperable ones computed by SipHash-2-4
+// (https://tools.ietf.org/html/rfc9018), so that servers of the same secret
+// accept cookies of each other. A zero Cookies is ready to use with a random
+// secret. Since options of the response are attached to Request.EdnsOptions,
+// the middleware must be chained after OptHandler, e.g.
+//
+//	router.Middleware = []Middleware{
+//		PanicHandler,
+//		RefusedHandler,
+//		OptHandler,
+//		cookies.Handler,
+//		...
+//	}
+type Cookies struct {
+	// Required makes requests over UDP without a valid server cookie responded
+	// with BADCOOKIE and a new server cookie, or REFUSED if without a COOKIE.
+	Required bool
+
+	mu       sync.RWMutex
+	secret   *[16]byte
+	previous *[16]byte
+}
+
+// Rotate replaces the secret, while server cookies generated by the previous
+// secret are still accepted until the next rotation. It should be called
+// periodically, e.g. every day, and at the same time among servers sharing
+// the secret (https://tools.ietf.org/html/rfc9018#section-5).
+func (c *Cookies) Rotate(secret [16]byte) {
+	c.mu.Lock()
+	c.previous, c.secret = c.secret, &secret
+	c.mu.Unlock()
+}
+
+// secrets returns the current and previous secrets, generating a random one if none.
+func (c *Cookies) secrets() (secret, previous *[16]byte) {
+	c.mu.RLock()
+	secret, previous = c.secret, c.previous
+	c.mu.RUnlock()
+	if secret != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.secret == nil {
+		c.secret = new([16]byte)
+		if _, err := rand.Read(c.secret[:]); err != nil {
+			panic(err)
+		}
+	}
+	return c.secret, c.previous
+}
+
+// Handler is a middleware processing COOKIE options. A request with a COOKIE
+// is responded with the client cookie and a new server cookie, and passed to h
+// with whether the server cookie is valid within the context. A request of a
+// malformed COOKIE is responded with FORMERR.
+func (c *Cookies) Handler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		var cookie *dns.EDNS0_COOKIE
+		if opt := req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if v, ok := o.(*dns.EDNS0_COOKIE); ok {
+					cookie = v
+					break
+				}
+			}
+		}
+
+		udp := connNetwork(w) == "udp"
+		if cookie == nil {
+			if c.Required && udp {
+				w.Msg().Rcode = dns.RcodeRefused
+				return
+			}
+			h.ServeDNS(w, req)
+			return
+		}
+
+		// https://tools.ietf.org/html/rfc7873#section-5.2.2
+		b, err := hex.DecodeString(cookie.Cookie)
+		if err != nil || len(b) != 8 && (len(b) < 16 || len(b) > 40) {
+			w.Msg().Rcode = dns.RcodeFormatError
+			return
+		}
+
+		var (
+			client    = b[:8:8]
+			ip        = addrIP(remoteAddr(w))
+			now       = uint32(time.Now().Unix())
+			secret, _ = c.secrets()
+			valid     = len(b) > 8 && c.verify(client, b[8:], ip, now)
+		)
+		req.EdnsOptions().Set(&dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(append(client, serverCookie(secret, client, ip, now)...)),
+		})
+		if !valid && c.Required && udp {
+			w.Msg().Rcode = dns.RcodeBadCookie
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), CookieContextKey, valid)
+		h.ServeDNS(w, req.WithContext(ctx))
+	})
+}
+
+// verify reports whether the server cookie is generated by the current or
+// previous secret for the client, and not expired.
+func (c *Cookies) verify(client, server []byte, ip net.IP, now uint32) bool {
+	if len(server) != 16 || server[0] != 1 {
+		return false
+	}
+
+	timestamp := binary.BigEndian.Uint32(server[4:])
+	if age := int32(now - timestamp); age > cookieMaxAge || age < -cookieMaxFuture {
+		return false
+	}
+
+	secret, previous := c.secrets()
+	for _, v := range []*[16]byte{secret, previous} {
+		if v != nil && subtle.ConstantTimeCompare(server, serverCookie(v, client, ip, timestamp)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// serverCookie returns the interoperable server cookie (https://tools.ietf.org/html/rfc9018#section-4).
+func serverCookie(secret *[16]byte, client []byte, ip net.IP, timestamp uint32) []byte {
+	cookie := make([]byte, 16)
+	cookie[0] = 1 // version
+	binary.BigEndian.PutUint32(cookie[4:], timestamp)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p := make([]byte, 0, len(client)+8+len(ip))
+	p = append(p, client...)
+	p = append(p, cookie[:8]...)
+	p = append(p, ip...)
+	binary.LittleEndian.PutUint64(cookie[8:], siphash(secret, p))
+	return cookie
+}
+
+// siphash returns the SipHash-2-4 of p (https://131002.net/siphash/).
+func siphash(key *[16]byte, p []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		compress(binary.LittleEndian.Uint64(p))
+	}
+	var last [8]byte
+	copy(last[:], p)
+	last[7] = byte(n)
+	compress(binary.LittleEndian.Uint64(last[:]))
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,164 @@
+package dnsrouter
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSiphash(t *testing.T) {
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	p := make([]byte, 15)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	// test vectors of the reference implementation
+	if h := siphash(&key, nil); h != 0x726fdb47dd0e0e31 {
+		t.Errorf("unexpected hash of empty input: %x", h)
+	}
+	if h := siphash(&key, p); h != 0xa129ca6149be45e5 {
+		t.Errorf("unexpected hash of 15 bytes: %x", h)
+	}
+}
+
+func TestServerCookie(t *testing.T) {
+	var secret [16]byte
+	hex.Decode(secret[:], []byte("e5e973e5a6b2a43f48e7dc849e37bfcf"))
+
+	// https://tools.ietf.org/html/rfc9018#appendix-A.1
+	tests := []struct {
+		client    string
+		ip        string
+		timestamp uint32
+		server    string
+	}{
+		{"2464c4abcf10c957", "198.51.100.100", 1559731985, "010000005cf79f111f8130c3eee29480"},
+	}
+	for _, test := range tests {
+		client, _ := hex.DecodeString(test.client)
+		if s := hex.EncodeToString(serverCookie(&secret, client, net.ParseIP(test.ip), test.timestamp)); s != test.server {
+			t.Errorf("%s: expected %s, got %s", test.client, test.server, s)
+		}
+	}
+}
+
+func TestCookies(t *testing.T) {
+	cookies := new(Cookies)
+	router := New()
+	router.Middleware = []Middleware{OptHandler, cookies.Handler, BasicHandler}
+	router.HandleFunc("www.example.org. 0 IN TXT", func(w ResponseWriter, req *Request) {
+		valid, _ := req.Context().Value(CookieContextKey).(bool)
+		txt := "invalid"
+		if valid {
+			txt = "valid"
+		}
+		w.Msg().Answer = append(w.Msg().Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{txt},
+		})
+	})
+
+	udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	query := func(addr net.Addr, cookie string) (*dns.Msg, string) {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.org.", dns.TypeTXT)
+		req.SetEdns0(4096, false)
+		if cookie != "" {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+
+		conn := &testConn{remoteAddr: addr}
+		Classic(context.Background(), router).ServeDNS(conn, req)
+		m := conn.msgs[0]
+
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if v, ok := o.(*dns.EDNS0_COOKIE); ok {
+					if len(v.Cookie) != 48 || v.Cookie[:16] != cookie[:16] {
+						t.Errorf("unexpected cookie %s", v.Cookie)
+					}
+					return m, v.Cookie
+				}
+			}
+		}
+		if cookie != "" && m.Rcode != dns.RcodeFormatError {
+			t.Errorf("expected COOKIE, got %v", m)
+		}
+		return m, ""
+	}
+
+	const client = "0102030405060708"
+
+	m, _ := query(udp, "")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("unexpected response: %v", m)
+	}
+	m, _ = query(udp, "0102")
+	if m.Rcode != dns.RcodeFormatError {
+		t.Errorf("expected FORMERR, got %v", m)
+	}
+
+	m, server := query(udp, client)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != "invalid" {
+		t.Errorf("unexpected response: %v", m)
+	}
+	m, _ = query(udp, server)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != "valid" {
+		t.Errorf("expected a valid cookie, got %v", m)
+	}
+
+	// from another client
+	m, _ = query(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5353}, server)
+	if m.Answer[0].(*dns.TXT).Txt[0] != "invalid" {
+		t.Errorf("expected an invalid cookie, got %v", m)
+	}
+
+	// accepted after one rotation
+	cookies.Rotate([16]byte{1})
+	m, _ = query(udp, server)
+	if m.Answer[0].(*dns.TXT).Txt[0] != "valid" {
+		t.Errorf("expected a valid cookie, got %v", m)
+	}
+	cookies.Rotate([16]byte{2})
+	m, _ = query(udp, server)
+	if m.Answer[0].(*dns.TXT).Txt[0] != "invalid" {
+		t.Errorf("expected an invalid cookie, got %v", m)
+	}
+
+	// expired
+	secret, _ := cookies.secrets()
+	b, _ := hex.DecodeString(client)
+	expired := client + hex.EncodeToString(serverCookie(secret, b, udp.IP, uint32(time.Now().Unix())-cookieMaxAge-1))
+	m, _ = query(udp, expired)
+	if m.Answer[0].(*dns.TXT).Txt[0] != "invalid" {
+		t.Errorf("expected an invalid cookie, got %v", m)
+	}
+
+	cookies.Required = true
+	m, _ = query(udp, "")
+	if m.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED, got %v", m)
+	}
+	m, server = query(udp, expired)
+	if m.Rcode != dns.RcodeBadCookie || len(m.Answer) != 0 {
+		t.Errorf("expected BADCOOKIE, got %v", m)
+	}
+	m, _ = query(udp, server)
+	if m.Rcode != dns.RcodeSuccess || m.Answer[0].(*dns.TXT).Txt[0] != "valid" {
+		t.Errorf("expected a valid cookie, got %v", m)
+	}
+	m, _ = query(tcp, client)
+	if m.Rcode != dns.RcodeSuccess || m.Answer[0].(*dns.TXT).Txt[0] != "invalid" {
+		t.Errorf("unexpected response over TCP: %v", m)
+	}
+}
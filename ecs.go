@@ -0,0 +1,93 @@
+package dnsrouter
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ClientSubnet is the EDNS Client Subnet of a request (https://tools.ietf.org/html/rfc7871),
+// which is parsed by OptHandler.
+type ClientSubnet struct {
+	// Family is 1 for IPv4, or 2 for IPv6.
+	Family uint16
+
+	// SourcePrefix is the number of significant leading bits of Address.
+	SourcePrefix uint8
+
+	// ScopePrefix is the number of leading bits of Address that the response
+	// covers, which is set by handlers using the subnet, and echoed by OptHandler.
+	// It is 0 by default, i.e. the response is suitable for all clients.
+	ScopePrefix uint8
+
+	Address net.IP
+}
+
+// IPNet returns the subnet of SourcePrefix.
+func (s *ClientSubnet) IPNet() *net.IPNet {
+	bits := 8 * net.IPv4len
+	if s.Family == 2 {
+		bits = 8 * net.IPv6len
+	}
+	mask := net.CIDRMask(int(s.SourcePrefix), bits)
+	return &net.IPNet{IP: s.Address.Mask(mask), Mask: mask}
+}
+
+// option returns the ECS option of the response.
+func (s *ClientSubnet) option() *dns.EDNS0_SUBNET {
+	bits := 8 * len(s.Address)
+	scope := s.ScopePrefix
+	if s.SourcePrefix == 0 {
+		// https://tools.ietf.org/html/rfc7871#section-7.1.3
+		scope = 0
+	} else if int(scope) > bits {
+		scope = uint8(bits)
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        s.Family,
+		SourceNetmask: s.SourcePrefix,
+		SourceScope:   scope,
+		Address:       s.Address,
+	}
+}
+
+type clientSubnetContextKeyType int
+
+const clientSubnetContextKey clientSubnetContextKeyType = 5
+
+// ClientSubnet returns the EDNS Client Subnet of the request, or nil if none.
+// Handlers should set ScopePrefix of the returned subnet if answers depend on it.
+func (r *Request) ClientSubnet() *ClientSubnet {
+	s, _ := r.Context().Value(clientSubnetContextKey).(*ClientSubnet)
+	return s
+}
+
+// parseClientSubnet returns the ECS option of the OPT, or false if it is
+// malformed (https://tools.ietf.org/html/rfc7871#section-7.1.2).
+func parseClientSubnet(opt *dns.OPT) (*ClientSubnet, bool) {
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok || e.DraftOption {
+			continue
+		}
+
+		s := &ClientSubnet{
+			Family:       e.Family,
+			SourcePrefix: e.SourceNetmask,
+			Address:      e.Address,
+		}
+		switch e.Family {
+		case 0:
+			// sent by dig if the source prefix is 0
+			s.Address = net.IPv4zero.To4()
+		case 1:
+			s.Address = e.Address.To4()
+		}
+		if e.SourceScope != 0 || !s.Address.Equal(s.IPNet().IP) {
+			return nil, false
+		}
+		return s, true
+	}
+	return nil, true
+}
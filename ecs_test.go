@@ -0,0 +1,78 @@
+package dnsrouter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientSubnet(t *testing.T) {
+	router := New()
+	router.HandleFunc("geo.example.org. 0 IN TXT", func(w ResponseWriter, req *Request) {
+		txt := "none"
+		if subnet := req.ClientSubnet(); subnet != nil {
+			txt = subnet.IPNet().String()
+			subnet.ScopePrefix = 24
+		}
+		w.Msg().Answer = append(w.Msg().Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{txt},
+		})
+	})
+
+	tests := []struct {
+		options []dns.EDNS0
+		rcode   int
+		txt     string
+		scope   int // -1 if no ECS in the response
+	}{
+		{nil, dns.RcodeSuccess, "none", -1},
+		{[]dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}, dns.RcodeSuccess, "none", -1},
+		{[]dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")}}, dns.RcodeSuccess, "192.0.2.0/24", 24},
+		{[]dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 16, Address: net.ParseIP("192.0.0.0")}}, dns.RcodeSuccess, "192.0.0.0/16", 24},
+		{[]dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 56, Address: net.ParseIP("2001:db8::")}}, dns.RcodeSuccess, "2001:db8::/56", 24},
+		{[]dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0, Address: net.ParseIP("0.0.0.0")}}, dns.RcodeSuccess, "0.0.0.0/0", 0},
+		{[]dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.1")}}, dns.RcodeFormatError, "", -1},
+		{[]dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("192.0.2.0")}}, dns.RcodeFormatError, "", -1},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("geo.example.org.", dns.TypeTXT)
+		req.SetEdns0(4096, false)
+		req.IsEdns0().Option = test.options
+
+		conn := &testConn{remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		Classic(context.Background(), router).ServeDNS(conn, req)
+		m := conn.msgs[0]
+
+		if m.Rcode != test.rcode {
+			t.Errorf("%d: expected rcode %d, got %v", i, test.rcode, m)
+			continue
+		}
+		if test.txt != "" && (len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != test.txt) {
+			t.Errorf("%d: expected %s, got %v", i, test.txt, m)
+		}
+
+		opt := m.IsEdns0()
+		if opt == nil {
+			t.Errorf("%d: expected OPT, got %v", i, m)
+			continue
+		}
+		if test.scope == -1 {
+			if len(opt.Option) != 0 {
+				t.Errorf("%d: unexpected options: %v", i, opt)
+			}
+			continue
+		}
+		if len(opt.Option) != 1 {
+			t.Errorf("%d: expected ECS only, got %v", i, opt)
+			continue
+		}
+		ecs, reqECS := opt.Option[0].(*dns.EDNS0_SUBNET), test.options[0].(*dns.EDNS0_SUBNET)
+		if ecs.Family != reqECS.Family || ecs.SourceNetmask != reqECS.SourceNetmask || !ecs.Address.Equal(reqECS.Address) || int(ecs.SourceScope) != test.scope {
+			t.Errorf("%d: unexpected ECS: %v", i, ecs)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package dnsrouter
+
+import "github.com/miekg/dns"
+
+// EdnsOptions is a registry of EDNS0 options of a response, to which middlewares
+// within OptHandler attach options, e.g. a COOKIE, and then OptHandler writes
+// them into the OPT of the response. It is safe to call methods on a nil
+// EdnsOptions, which does nothing, i.e. the request is without EDNS0.
+type EdnsOptions struct {
+	options []dns.EDNS0
+}
+
+// Set adds the option, replacing the one of the same code if any.
+func (o *EdnsOptions) Set(option dns.EDNS0) {
+	if o == nil {
+		return
+	}
+	for i, v := range o.options {
+		if v.Option() == option.Option() {
+			o.options[i] = option
+			return
+		}
+	}
+	o.options = append(o.options, option)
+}
+
+// Get returns the option of the code, or nil if none.
+func (o *EdnsOptions) Get(code uint16) dns.EDNS0 {
+	if o == nil {
+		return nil
+	}
+	for _, v := range o.options {
+		if v.Option() == code {
+			return v
+		}
+	}
+	return nil
+}
+
+// Del removes the option of the code.
+func (o *EdnsOptions) Del(code uint16) {
+	if o == nil {
+		return
+	}
+	for i, v := range o.options {
+		if v.Option() == code {
+			o.options = append(o.options[:i], o.options[i+1:]...)
+			return
+		}
+	}
+}
+
+type ednsOptionsContextKeyType int
+
+const ednsOptionsContextKey ednsOptionsContextKeyType = 6
+
+// EdnsOptions returns the registry of EDNS0 options of the response, or nil
+// if the request is without EDNS0 or not passed through OptHandler.
+func (r *Request) EdnsOptions() *EdnsOptions {
+	o, _ := r.Context().Value(ednsOptionsContextKey).(*EdnsOptions)
+	return o
+}
@@ -0,0 +1,93 @@
+package dnsrouter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestOptHandler(t *testing.T) {
+	router := New()
+	router.Handle("www.example.org. 3600 IN A 127.0.0.1", nil)
+	router.Middleware = append([]Middleware{}, DefaultScheme...)
+	router.Middleware = append(router.Middleware, func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			options := req.EdnsOptions()
+			options.Set(&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "00"})
+			options.Set(&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "01"})
+			options.Set(&dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte{1}})
+			options.Del(dns.EDNS0LOCALSTART)
+			h.ServeDNS(w, req)
+		})
+	})
+
+	tests := []struct {
+		ctx     context.Context
+		edns    bool
+		version uint8
+		do      bool
+		rcode   int
+		udpSize uint16
+	}{
+		{context.Background(), false, 0, false, dns.RcodeSuccess, 0},
+		{context.Background(), true, 0, false, dns.RcodeSuccess, DefaultMaxUDPSize},
+		{context.Background(), true, 0, true, dns.RcodeSuccess, DefaultMaxUDPSize},
+		{context.WithValue(context.Background(), MaxUDPSizeContextKey, 1232), true, 0, false, dns.RcodeSuccess, 1232},
+		{context.Background(), true, 1, true, dns.RcodeBadVers, DefaultMaxUDPSize},
+	}
+	for i, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.org.", dns.TypeA)
+		if test.edns {
+			req.SetEdns0(512, test.do)
+			opt := req.IsEdns0()
+			opt.SetVersion(test.version)
+			opt.Option = append(opt.Option,
+				&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+				&dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART + 1, Data: []byte{1}},
+			)
+		}
+
+		conn := &testConn{remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		Classic(test.ctx, router).ServeDNS(conn, req)
+		m := conn.msgs[0]
+
+		if m.Rcode != test.rcode {
+			t.Errorf("%d: expected rcode %d, got %v", i, test.rcode, m)
+			continue
+		}
+		if (m.Rcode == dns.RcodeSuccess) != (len(m.Answer) == 1) {
+			t.Errorf("%d: unexpected answer: %v", i, m)
+		}
+
+		opt := m.IsEdns0()
+		if !test.edns {
+			if opt != nil {
+				t.Errorf("%d: unexpected OPT: %v", i, m)
+			}
+			continue
+		}
+		if opt == nil || opt.Version() != 0 || opt.Do() != test.do || opt.UDPSize() != test.udpSize {
+			t.Errorf("%d: unexpected OPT: %v", i, m)
+			continue
+		}
+		if test.rcode == dns.RcodeBadVers {
+			if len(opt.Option) != 0 {
+				t.Errorf("%d: unexpected options: %v", i, opt)
+			}
+			continue
+		}
+		if len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_NSID).Nsid != "01" {
+			t.Errorf("%d: unexpected options: %v", i, opt)
+		}
+	}
+
+	var options *EdnsOptions
+	options.Set(&dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	options.Del(dns.EDNS0NSID)
+	if options.Get(dns.EDNS0NSID) != nil {
+		t.Errorf("expected nothing from nil options")
+	}
+}
@@ -0,0 +1,122 @@
+package dnsrouter
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Export writes every zone of the class in master file format, one after
+// another in canonical order of origins, see ExportZone for details.
+// Records which are not covered by any zone, i.e. no SOA at or above the
+// names, are not written.
+func (r *Router) Export(w io.Writer, qclass uint16) error {
+	root := r.loadTrees()[qclass]
+	if root == nil {
+		return nil
+	}
+
+	var origins []string
+	seen := make(map[string]bool)
+	root.walk(func(n *node) {
+		if n.data == nil || n.data.rrType&rrSoa == 0 {
+			return
+		}
+		for _, rr := range answerRecords(n.data.handler.Search(dns.TypeSOA), nil) {
+			name := strings.ToLower(rr.Header().Name)
+			if !seen[name] {
+				seen[name] = true
+				origins = append(origins, name)
+			}
+		}
+	})
+	sort.Slice(origins, func(i, j int) bool {
+		return canonicalLess(newIndexableName(origins[i]), newIndexableName(origins[j]))
+	})
+
+	bw := bufio.NewWriter(w)
+	for i, origin := range origins {
+		rrs := treeZone(root, origin)
+		if rrs == nil {
+			continue
+		}
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		writeZone(bw, rrs)
+	}
+	return bw.Flush()
+}
+
+// ExportZone writes records of the zone currently served in master file format
+// (https://tools.ietf.org/html/rfc1035#section-5), which consists of the same
+// records as a zone transfer, i.e. records of static Answer handlers in
+// canonical order led by the SOA. It returns ErrNoZone if no such zone.
+func (r *Router) ExportZone(w io.Writer, origin string, qclass uint16) error {
+	rrs := r.zone(origin, qclass)
+	if rrs == nil {
+		return ErrNoZone
+	}
+	return WriteZone(w, rrs)
+}
+
+// WriteZone writes records in master file format (https://tools.ietf.org/html/rfc1035#section-5).
+// If the records are led by a SOA, e.g. returned by ZoneSigner.Sign, the
+// $ORIGIN and $TTL are set by the SOA, then owner names are relative to the
+// origin and consecutive records of the same owner are grouped, otherwise
+// one record per line with fully qualified names.
+func WriteZone(w io.Writer, rrs []dns.RR) error {
+	bw := bufio.NewWriter(w)
+	writeZone(bw, rrs)
+	return bw.Flush()
+}
+
+// writeZone writes records into the buffer, errors are kept by the buffer until flushed.
+func writeZone(w *bufio.Writer, rrs []dns.RR) {
+	var soa *dns.SOA
+	if len(rrs) > 0 {
+		soa, _ = rrs[0].(*dns.SOA)
+	}
+	if soa == nil {
+		for _, rr := range rrs {
+			w.WriteString(rr.String() + "\n")
+		}
+		return
+	}
+
+	origin := soa.Hdr.Name
+	w.WriteString("$ORIGIN " + origin + "\n")
+	w.WriteString("$TTL " + strconv.FormatUint(uint64(soa.Hdr.Ttl), 10) + "\n")
+
+	var owner string
+	for i, rr := range rrs {
+		hdr := rr.Header()
+
+		var name string
+		if i == 0 || !equalName(hdr.Name, owner) {
+			owner = hdr.Name
+			switch {
+			case equalName(owner, origin):
+				name = "@"
+			case dns.IsSubDomain(origin, owner):
+				name = dns.Name(owner[:len(owner)-len(origin)-1]).String()
+			default:
+				name = dns.Name(owner).String()
+			}
+		}
+
+		// the TTL is omitted if it is the same as $TTL
+		var ttl string
+		if hdr.Ttl != soa.Hdr.Ttl {
+			ttl = strconv.FormatUint(uint64(hdr.Ttl), 10)
+		}
+		w.WriteString(name + "\t" + ttl + "\t" +
+			dns.Class(hdr.Class).String() + "\t" +
+			dns.Type(hdr.Rrtype).String() + "\t" +
+			strings.TrimPrefix(rr.String(), hdr.String()) + "\n")
+	}
+}
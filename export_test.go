@@ -0,0 +1,77 @@
+package dnsrouter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRouterExport(t *testing.T) {
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 127.0.0.1",
+		"www 300 IN A 127.0.0.2",
+		"www 300 IN AAAA ::1",
+		"*.w 3600 IN TXT wildcard",
+		"sub 3600 IN NS ns.sub",
+		"ns.sub 3600 IN A 127.0.0.3",
+	)), "example.org.", "stdin")
+	router.HandleZone(strings.NewReader(newTestZone("child.example.org.", 1,
+		"www 3600 IN A 127.0.0.4",
+	)), "child.example.org.", "stdin")
+	router.Handle("mail.example.org. 3600 IN A 127.0.0.5", nil)
+	router.Handle(":user.dyn.example.org. 3600 IN A 127.0.0.6", nil)
+	router.Handle("www.example.com. 3600 IN A 127.0.0.7", nil)
+
+	var buf bytes.Buffer
+	if err := router.ExportZone(&buf, "example.com.", dns.ClassINET); err != ErrNoZone {
+		t.Fatalf("expected ErrNoZone, got %v", err)
+	}
+	if err := router.ExportZone(&buf, "Example.Org", dns.ClassINET); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"$ORIGIN example.org.",
+		"$TTL 3600",
+		"@\t\tIN\tSOA\tns.example.org. admin.example.org. 1 7200 3600 604800 3600",
+		"\t\tIN\tNS\tns.example.org.",
+		"mail\t\tIN\tA\t127.0.0.5",
+		"ns\t\tIN\tA\t127.0.0.1",
+		"sub\t\tIN\tNS\tns.sub.example.org.",
+		"ns.sub\t\tIN\tA\t127.0.0.3",
+		"*.w\t\tIN\tTXT\t\"wildcard\"",
+		"www\t300\tIN\tA\t127.0.0.2",
+		"\t300\tIN\tAAAA\t::1",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	rrs, err := parseZone(&buf, "", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := sortedStrings(rrs), sortedStrings(router.zone("example.org.", dns.ClassINET)); strings.Join(a, "\n") != strings.Join(b, "\n") {
+		t.Errorf("unexpected parsed zone:\n%s", strings.Join(a, "\n"))
+	}
+
+	buf.Reset()
+	if err := router.Export(&buf, dns.ClassINET); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); !strings.HasPrefix(s, expected+"\n$ORIGIN child.example.org.\n") || strings.Contains(s, "example.com.") {
+		t.Errorf("unexpected output:\n%s", s)
+	}
+	rrs, err = parseZone(&buf, "", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 11 {
+		t.Errorf("expected 11 records, got %v", rrs)
+	}
+}
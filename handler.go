@@ -2,9 +2,12 @@ package dnsrouter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -13,19 +16,189 @@ import (
 // Middleware is a piece of middleware.
 type Middleware func(Handler) Handler
 
+// ErrNoConn is returned by ConnInfo.TsigStatus if no underlying connection.
+var ErrNoConn = errors.New("dnsrouter: no underlying connection")
+
 // A ResponseWriter interface is used by a DNS handler to construct an DNS response.
+// The ResponseWriter created by Classic also implements Sizer, ConnInfo and
+// Hijacker, which should be checked by type assertion since wrappers of a
+// ResponseWriter may not implement them.
 type ResponseWriter interface {
 	Msg() *dns.Msg
 }
 
+// A ConnInfo is implemented by a ResponseWriter to tell about the underlying
+// connection, which is meaningful only if created by Classic.
+type ConnInfo interface {
+	// RemoteAddr returns the address of the client, or nil if unknown.
+	RemoteAddr() net.Addr
+
+	// LocalAddr returns the address of the server, or nil if unknown.
+	LocalAddr() net.Addr
+
+	// Network returns "udp" or "tcp" the request is received from, or empty if unknown.
+	Network() string
+
+	// TsigStatus returns the status of verifying the request TSIG, which is
+	// nil if verified or no TSIG, or ErrNoConn if no underlying connection.
+	TsigStatus() error
+}
+
+// A Hijacker is implemented by a ResponseWriter to allow a handler to take
+// over the underlying writer, which is meaningful only if created by Classic.
+type Hijacker interface {
+	// Hijack takes over the underlying writer, e.g. to stream multiple messages,
+	// after which Msg is no longer written. It returns nil if no underlying
+	// writer, in which case nothing is changed.
+	Hijack() dns.ResponseWriter
+
+	// Hijacked reports whether Hijack has taken over the underlying writer.
+	Hijacked() bool
+}
+
+// remoteAddr returns the address of the client, or nil if unknown.
+func remoteAddr(w ResponseWriter) net.Addr {
+	if c, ok := w.(ConnInfo); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+// connNetwork returns "udp" or "tcp" the request is received from, or empty if unknown.
+func connNetwork(w ResponseWriter) string {
+	if c, ok := w.(ConnInfo); ok {
+		return c.Network()
+	}
+	return ""
+}
+
+// tsigStatus returns the status of verifying the request TSIG, or ErrNoConn
+// if w doesn't implement ConnInfo.
+func tsigStatus(w ResponseWriter) error {
+	if c, ok := w.(ConnInfo); ok {
+		return c.TsigStatus()
+	}
+	return ErrNoConn
+}
+
+// hijack takes over the underlying writer, or returns nil if w doesn't
+// implement Hijacker.
+func hijack(w ResponseWriter) dns.ResponseWriter {
+	if h, ok := w.(Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil
+}
+
+// isHijacked reports whether the underlying writer has been taken over.
+func isHijacked(w ResponseWriter) bool {
+	h, ok := w.(Hijacker)
+	return ok && h.Hijacked()
+}
+
+// A Sizer is implemented by a ResponseWriter of which the message size is
+// limited, e.g. the one created by Classic.
+type Sizer interface {
+	// Len returns the size of the message in wire format with compression,
+	// as if it is written at present.
+	Len() int
+
+	// MaxLen returns the maximum size of the message, see Classic for details.
+	MaxLen() int
+}
+
+// maxLen returns the maximum size of the message written by w, which is
+// dns.MaxMsgSize unless w implements Sizer.
+func maxLen(w ResponseWriter) int {
+	if s, ok := w.(Sizer); ok {
+		return s.MaxLen()
+	}
+	return dns.MaxMsgSize
+}
+
+// Making sure the responseWriter conforms with optional interfaces.
+var (
+	_ Sizer    = new(responseWriter)
+	_ ConnInfo = new(responseWriter)
+	_ Hijacker = new(responseWriter)
+)
+
 type responseWriter struct {
 	msg dns.Msg
+
+	// req is the request if created by Classic
+	req *dns.Msg
+	// maxLen is the maximum size of the response, or 0 if unlimited
+	maxLen int
+
+	// conn is the underlying connection if created by Classic
+	conn dns.ResponseWriter
+	// hijacked means the response has been written through conn
+	hijacked bool
 }
 
 func (p *responseWriter) Msg() *dns.Msg {
 	return &p.msg
 }
 
+func (p *responseWriter) Len() int {
+	m := p.msg
+	m.Compress = true
+	if m.Question == nil && p.req != nil {
+		m.Question = p.req.Question
+	}
+	return m.Len()
+}
+
+func (p *responseWriter) MaxLen() int {
+	if p.maxLen > 0 {
+		return p.maxLen
+	}
+	return dns.MaxMsgSize
+}
+
+func (p *responseWriter) RemoteAddr() net.Addr {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.RemoteAddr()
+}
+
+func (p *responseWriter) LocalAddr() net.Addr {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.LocalAddr()
+}
+
+func (p *responseWriter) Network() string {
+	switch p.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return "udp"
+	case *net.TCPAddr:
+		return "tcp"
+	}
+	return ""
+}
+
+func (p *responseWriter) TsigStatus() error {
+	if p.conn == nil {
+		return ErrNoConn
+	}
+	return p.conn.TsigStatus()
+}
+
+func (p *responseWriter) Hijack() dns.ResponseWriter {
+	if p.conn != nil {
+		p.hijacked = true
+	}
+	return p.conn
+}
+
+func (p *responseWriter) Hijacked() bool {
+	return p.hijacked
+}
+
 // NewResponseWriter creates a response writer.
 func NewResponseWriter() ResponseWriter {
 	return new(responseWriter)
@@ -414,6 +587,17 @@ func NsecHandler(h Handler) Handler {
 			return
 		}
 
+		// NSEC3 is used if the enclosing zone of SOA has NSEC3PARAM
+		for authZone, authDelegated := zone, delegated; authZone != nil; authZone, authDelegated = authZone.Zone() {
+			if !authDelegated {
+				if _, ok := authZone.Search(dns.TypeNSEC3PARAM).(RcodeHandler); !ok {
+					nsec3Proofs(w, req, class.Stub())
+					return
+				}
+				break
+			}
+		}
+
 		if delegated && Exists(result.Ns, dns.TypeNS) {
 			return
 		}
@@ -473,6 +657,131 @@ func NsecHandler(h Handler) Handler {
 	})
 }
 
+// CompactNsecHandler returns a middleware that filling out denial-of-existence
+// records by minimal NSEC, a.k.a. black lies, instead of walking the tree like
+// NsecHandler, which prevents zone enumeration and works for records having no
+// precomputed NSEC, e.g. named parameters.
+// A NSEC owned by the query name (or the delegation point of a referral) with
+// next name "\000.qname" is synthesized, its type bitmap lists the types of
+// the name, so a nonexistent name is responded as NOERROR without data.
+// It only works with online signing, and since there is no wildcard proof,
+// it relies on the Signer placed before WildcardHandler to sign expanded
+// answers as owned by the query name, e.g.
+//
+//	router.Middleware = []Middleware{
+//		PanicHandler,
+//		RefusedHandler,
+//		OptHandler,
+//		signer.Handler,
+//		WildcardHandler,
+//		CompactNsecHandler,
+//		NsHandler,
+//		ExtraHandler,
+//		CnameHandler,
+//		BasicHandler,
+//	}
+func CompactNsecHandler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		h.ServeDNS(w, req)
+
+		var (
+			qname  = req.Question[0].Name
+			qtype  = req.Question[0].Qtype
+			result = w.Msg()
+		)
+
+		if qtype == dns.TypeANY ||
+			result.Rcode != dns.RcodeNameError && result.Rcode != dns.RcodeSuccess ||
+			ExistsAny(result.Ns, dns.TypeNSEC, dns.TypeNSEC3) {
+			return
+		}
+
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			return
+		}
+
+		var class Class
+		if classValue := req.Context().Value(ClassContextKey); classValue != nil {
+			class = classValue.(Class)
+		} else {
+			return
+		}
+
+		zone, delegated := class.Zone()
+		if zone == nil {
+			return
+		}
+
+		var (
+			owner = qname
+			types []uint16
+		)
+
+		if i := First(result.Ns, dns.TypeNS); delegated && i != -1 {
+			// proves the absence of DS for an unsigned delegation
+			if Exists(result.Ns, dns.TypeDS) {
+				return
+			}
+			owner = result.Ns[i].Header().Name
+			types = append(types, dns.TypeNS)
+		} else if ExistsAny(result.Answer, dns.TypeCNAME, qtype) {
+			return
+		} else if result.Rcode == dns.RcodeNameError {
+			result.Rcode = dns.RcodeSuccess
+		} else {
+			m := FurtherRequest(w, req, qname, dns.TypeANY, class.Search(dns.TypeANY))
+			for _, rr := range m.Answer {
+				t := rr.Header().Rrtype
+				if t == dns.TypeRRSIG || t == dns.TypeNSEC {
+					continue
+				}
+				exists := false
+				for _, v := range types {
+					if v == t {
+						exists = true
+						break
+					}
+				}
+				if !exists {
+					types = append(types, t)
+				}
+			}
+		}
+
+		// the TTL of NSEC is the minimum TTL of SOA (https://tools.ietf.org/html/rfc4034#section-4)
+		var soa *dns.SOA
+		for authZone, authDelegated := zone, delegated; authZone != nil; authZone, authDelegated = authZone.Zone() {
+			if !authDelegated {
+				m := FurtherRequest(w, req, qname, dns.TypeSOA, authZone.Search(dns.TypeSOA))
+				if i := First(m.Answer, dns.TypeSOA); i != -1 {
+					soa = m.Answer[i].(*dns.SOA)
+				}
+				break
+			}
+		}
+		if soa == nil {
+			return
+		}
+
+		nsec := new(dns.NSEC)
+		nsec.Hdr = dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  req.Question[0].Qclass,
+			Ttl:    soa.Minttl,
+		}
+		if soa.Hdr.Ttl < nsec.Hdr.Ttl {
+			nsec.Hdr.Ttl = soa.Hdr.Ttl
+		}
+		nsec.NextDomain = `\000.` + owner
+		nsec.TypeBitMap = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Slice(nsec.TypeBitMap, func(i, j int) bool {
+			return nsec.TypeBitMap[i] < nsec.TypeBitMap[j]
+		})
+		result.Ns = append(result.Ns, nsec)
+	})
+}
+
 // WildcardHandler is a middleware expanding wildcard.
 func WildcardHandler(h Handler) Handler {
 	return HandlerFunc(func(w ResponseWriter, req *Request) {
@@ -486,29 +795,55 @@ func WildcardHandler(h Handler) Handler {
 	})
 }
 
-// OptHandler is a middleware filling out OPT records if request is compatible with EDNS0.
+// OptHandler is a middleware filling out OPT records if request is compatible with EDNS0
+// (https://tools.ietf.org/html/rfc6891). The OPT of the response advertises the
+// maximum UDP size configured by MaxUDPSizeContextKey, and consists of options
+// attached to Request.EdnsOptions, while options of the request are not echoed.
+// The EDNS Client Subnet option of the request is available by Request.ClientSubnet,
+// and echoed with the scope prefix set by handlers. A request of an EDNS version
+// other than 0 is responded with BADVERS, and a request of a malformed ECS option
+// is responded with FORMERR.
 func OptHandler(h Handler) Handler {
 	return HandlerFunc(func(w ResponseWriter, req *Request) {
-		h.ServeDNS(w, req)
+		opt := req.IsEdns0()
+		if opt == nil {
+			h.ServeDNS(w, req)
+			return
+		}
 
-		if opt := req.IsEdns0(); opt != nil {
-			result := w.Msg()
-			if resultOpt := result.IsEdns0(); resultOpt != nil {
-				return
+		options := new(EdnsOptions)
+		subnet, ok := parseClientSubnet(opt)
+		switch {
+		case opt.Version() != 0:
+			w.Msg().Rcode = dns.RcodeBadVers
+			subnet = nil
+		case !ok:
+			w.Msg().Rcode = dns.RcodeFormatError
+		default:
+			ctx := context.WithValue(req.Context(), ednsOptionsContextKey, options)
+			if subnet != nil {
+				ctx = context.WithValue(ctx, clientSubnetContextKey, subnet)
 			}
+			h.ServeDNS(w, req.WithContext(ctx))
+		}
 
-			resultOpt := *opt
-			resultOpt.Hdr.Name = "."
-			resultOpt.Hdr.Rrtype = dns.TypeOPT
-			resultOpt.SetVersion(0)
-			resultOpt.SetUDPSize(opt.UDPSize())
-			resultOpt.Hdr.Ttl &= 0xff00 // clear flags
+		result := w.Msg()
+		if resultOpt := result.IsEdns0(); resultOpt != nil {
+			return
+		}
 
-			if opt.Do() {
-				resultOpt.SetDo()
-			}
-			result.Extra = append(result.Extra, &resultOpt)
+		resultOpt := new(dns.OPT)
+		resultOpt.Hdr.Name = "."
+		resultOpt.Hdr.Rrtype = dns.TypeOPT
+		resultOpt.SetUDPSize(uint16(maxUDPSize(req.Context())))
+		if opt.Do() {
+			resultOpt.SetDo()
 		}
+		if subnet != nil {
+			options.Set(subnet.option())
+		}
+		resultOpt.Option = options.options
+		result.Extra = append(result.Extra, resultOpt)
 	})
 }
 
@@ -575,17 +910,44 @@ func FurtherRequest(w ResponseWriter, req *Request, qname string, qtype uint16,
 	return *w.Msg()
 }
 
+// DefaultMaxUDPSize is the default maximum size of responses over UDP.
+const DefaultMaxUDPSize = dns.DefaultMsgSize
+
+type maxUDPSizeContextKeyType int
+
+// MaxUDPSizeContextKey is used to configure the maximum size of responses
+// over UDP by an int value within the context given to Classic.
+const MaxUDPSizeContextKey maxUDPSizeContextKeyType = 3
+
 // Classic converts a Handler into the github.com/miekg/dns.Handler.
+// Responses are written with name compression. A response over UDP is limited
+// to 512 bytes (https://tools.ietf.org/html/rfc1035#section-4.2.1), or the
+// UDP payload size of the EDNS0 request (https://tools.ietf.org/html/rfc6891#section-6.2.5)
+// but no more than the maximum configured by MaxUDPSizeContextKey, which
+// defaults to DefaultMaxUDPSize, while a response over TCP is limited to
+// 65535 bytes, both including the MAC of a signed response. An oversized
+// response drops ADDITIONAL records except OPT and TSIG, then the TC bit is
+// set without ANSWER and AUTHORITY records if it still doesn't fit.
 func Classic(ctx context.Context, h Handler) dns.Handler {
 	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
-		resp := NewResponseWriter()
 		req := &Request{Msg: r, ctx: ctx}
+		resp := &responseWriter{req: r, conn: w}
+		if resp.Network() == "udp" {
+			resp.maxLen = udpSize(req)
+		}
+
 		h.ServeDNS(resp, req)
+		if resp.Hijacked() {
+			return
+		}
 
 		msg := resp.Msg()
 		rcode := msg.Rcode
 		msg = msg.SetReply(r)
 		msg.Rcode = rcode
+		msg.Compress = true
+		truncate(msg, resp.MaxLen())
+		copyMsgRecords(msg)
 
 		if err := w.WriteMsg(msg); err != nil {
 			log.Println("dns.WriteMsg error:", err)
@@ -593,6 +955,79 @@ func Classic(ctx context.Context, h Handler) dns.Handler {
 	})
 }
 
+// udpSize returns the maximum size of the response over UDP.
+func udpSize(req *Request) int {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	max := maxUDPSize(req.Context())
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// maxUDPSize returns the maximum size of responses over UDP configured in the context.
+func maxUDPSize(ctx context.Context) int {
+	max, _ := ctx.Value(MaxUDPSizeContextKey).(int)
+	if max <= 0 || max > dns.MaxMsgSize {
+		max = DefaultMaxUDPSize
+	}
+	return max
+}
+
+// copyMsgRecords replaces records of the message with copies, since records
+// are shared with the Router, and packing a message writes into their headers.
+func copyMsgRecords(m *dns.Msg) {
+	m.Answer = copyRecords(m.Answer)
+	m.Ns = copyRecords(m.Ns)
+	m.Extra = copyRecords(m.Extra)
+}
+
+// copyRecords returns a deep copy of records.
+func copyRecords(rrs []dns.RR) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	l := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		l[i] = dns.Copy(rr)
+	}
+	return l
+}
+
+// truncate fits the message into the size, see Classic for details.
+func truncate(m *dns.Msg, size int) {
+	if m.IsTsig() != nil {
+		// the MAC is filled while signing
+		size -= maxTsigMACSize
+	}
+	if m.Len() <= size {
+		return
+	}
+
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if t := rr.Header().Rrtype; t == dns.TypeOPT || t == dns.TypeTSIG {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	if m.Len() <= size {
+		return
+	}
+
+	m.Truncated = true
+	m.Answer = nil
+	m.Ns = nil
+}
+
 // ChainHandler applies middlewares on given handler.
 func ChainHandler(h Handler, middlewares ...Middleware) Handler {
 	for i, n := 0, len(middlewares); i < n; i++ {
@@ -0,0 +1,229 @@
+package dnsrouter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassicTruncate(t *testing.T) {
+	var records []string
+	for i := 0; i < 20; i++ {
+		records = append(records,
+			fmt.Sprintf("mx 3600 IN MX %d mail%d", i, i),
+			fmt.Sprintf("mail%d 3600 IN A 127.0.0.%d", i, i),
+		)
+	}
+	for i := 0; i < 20; i++ {
+		records = append(records, fmt.Sprintf("txt 3600 IN TXT \"%s\"", strings.Repeat("x", 100)+fmt.Sprint(i)))
+	}
+
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1, records...)), "example.org.", "stdin")
+
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+	query := func(ctx context.Context, qname string, qtype uint16, udpSize uint16, addr net.Addr) *dns.Msg {
+		conn := &testConn{remoteAddr: addr}
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+		if udpSize > 0 {
+			req.SetEdns0(udpSize, false)
+		}
+		Classic(ctx, router).ServeDNS(conn, req)
+		if len(conn.msgs) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(conn.msgs))
+		}
+		return conn.msgs[0]
+	}
+
+	tests := []struct {
+		qname     string
+		qtype     uint16
+		udpSize   uint16
+		addr      net.Addr
+		truncated bool
+		answer    int
+		extra     int
+	}{
+		// fits
+		{"mx.example.org.", dns.TypeMX, 0, tcp, false, 20, 20},
+		{"mx.example.org.", dns.TypeMX, 4096, udp, false, 20, 21},
+		// drops ADDITIONAL
+		{"mx.example.org.", dns.TypeMX, 0, udp, false, 20, 0},
+		{"mx.example.org.", dns.TypeMX, 600, udp, false, 20, 1},
+		// sets TC
+		{"txt.example.org.", dns.TypeTXT, 0, udp, true, 0, 0},
+		{"txt.example.org.", dns.TypeTXT, 1024, udp, true, 0, 1},
+		{"txt.example.org.", dns.TypeTXT, 4096, udp, false, 20, 1},
+		{"txt.example.org.", dns.TypeTXT, 0, tcp, false, 20, 0},
+	}
+	for _, test := range tests {
+		m := query(context.Background(), test.qname, test.qtype, test.udpSize, test.addr)
+		if m.Truncated != test.truncated || len(m.Answer) != test.answer || len(m.Extra) != test.extra {
+			t.Errorf("%s %d over %s: unexpected response: %v", test.qname, test.udpSize, test.addr.Network(), m)
+		}
+		if test.addr == udp {
+			size := dns.MinMsgSize
+			if test.udpSize > 0 {
+				size = int(test.udpSize)
+			}
+			if m.Len() > size {
+				t.Errorf("%s %d: message size %d exceeds %d", test.qname, test.udpSize, m.Len(), size)
+			}
+		}
+	}
+
+	// the server side maximum
+	ctx := context.WithValue(context.Background(), MaxUDPSizeContextKey, 1024)
+	m := query(ctx, "txt.example.org.", dns.TypeTXT, 4096, udp)
+	if !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("unexpected response: %v", m)
+	}
+
+	// room for the MAC of a signed response
+	m = query(context.Background(), "txt.example.org.", dns.TypeTXT, 4096, udp)
+	m.SetTsig("key.example.org.", dns.HmacSHA256, DefaultTsigFudge, 0)
+	size := m.Len() + maxTsigMACSize
+	if truncate(m, size); m.Truncated {
+		t.Errorf("unexpected truncated response within %d: %v", size, m)
+	}
+	if truncate(m, size-1); !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("unexpected response within %d: %v", size-1, m)
+	}
+}
+
+func TestResponseWriterLen(t *testing.T) {
+	router := New()
+	for i := 0; i < 20; i++ {
+		router.Handle(fmt.Sprintf("mx.example.org. 3600 IN MX %d mail%d.example.org.", i, i), nil)
+	}
+
+	var size, maxSize int
+	h := ChainHandler(router, func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			h.ServeDNS(w, req)
+			size, maxSize = w.(Sizer).Len(), w.(Sizer).MaxLen()
+		})
+	})
+
+	tests := []struct {
+		addr    net.Addr
+		udpSize uint16
+		maxSize int
+	}{
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, 0, dns.MinMsgSize},
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, 1232, 1232},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, 1232, dns.MaxMsgSize},
+	}
+	for _, test := range tests {
+		conn := &testConn{remoteAddr: test.addr}
+		req := new(dns.Msg)
+		req.SetQuestion("mx.example.org.", dns.TypeMX)
+		if test.udpSize > 0 {
+			req.SetEdns0(test.udpSize, false)
+		}
+		Classic(context.Background(), h).ServeDNS(conn, req)
+
+		m := conn.msgs[0]
+		if !m.Compress {
+			t.Errorf("expected a compressed response")
+		}
+		if len(m.Answer) != 20 {
+			t.Fatalf("unexpected response: %v", m)
+		}
+		if size != m.Len() || maxSize != test.maxSize {
+			t.Errorf("%s %d: expected %d/%d, got %d/%d", test.addr.Network(), test.udpSize, m.Len(), test.maxSize, size, maxSize)
+		}
+		m.Compress = false
+		if size >= m.Len() {
+			t.Errorf("expected compressed size %d less than %d", size, m.Len())
+		}
+	}
+
+	w := NewResponseWriter().(Sizer)
+	if w.Len() != 12 || w.MaxLen() != dns.MaxMsgSize {
+		t.Errorf("unexpected size %d/%d", w.Len(), w.MaxLen())
+	}
+
+	// a wrapper without Sizer is unlimited
+	if size := maxLen(struct{ ResponseWriter }{NewResponseWriter()}); size != dns.MaxMsgSize {
+		t.Errorf("unexpected size %d of a wrapper", size)
+	}
+}
+
+func TestResponseWriterConn(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+
+	h := HandlerFunc(func(w ResponseWriter, req *Request) {
+		c := w.(ConnInfo)
+		w.Msg().Answer = append(w.Msg().Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{c.RemoteAddr().String(), c.LocalAddr().String(), c.Network(), fmt.Sprint(c.TsigStatus())},
+		})
+		if req.Question[0].Qtype != dns.TypeAXFR {
+			return
+		}
+
+		conn := w.(Hijacker).Hijack()
+		if conn == nil || !isHijacked(w) {
+			t.Fatal("expected hijacked")
+		}
+		for i := 0; i < 2; i++ {
+			m := new(dns.Msg)
+			m.SetReply(req.Msg)
+			conn.WriteMsg(m)
+		}
+	})
+
+	tests := []struct {
+		addr  net.Addr
+		qtype uint16
+		txt   string
+		msgs  int
+	}{
+		{udp, dns.TypeTXT, "192.0.2.1:5353 127.0.0.1:53 udp <nil>", 1},
+		{tcp, dns.TypeTXT, "192.0.2.1:5353 127.0.0.1:53 tcp <nil>", 1},
+		{tcp, dns.TypeAXFR, "", 2},
+	}
+	for _, test := range tests {
+		conn := &testConn{remoteAddr: test.addr}
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", test.qtype)
+		Classic(context.Background(), h).ServeDNS(conn, req)
+
+		if len(conn.msgs) != test.msgs {
+			t.Fatalf("%s %s: expected %d messages, got %d", test.addr.Network(), dns.TypeToString[test.qtype], test.msgs, len(conn.msgs))
+		}
+		if test.txt == "" {
+			continue
+		}
+		m := conn.msgs[0]
+		if len(m.Answer) != 1 || strings.Join(m.Answer[0].(*dns.TXT).Txt, " ") != test.txt {
+			t.Errorf("%s: unexpected response: %v", test.addr.Network(), m)
+		}
+	}
+
+	w := NewResponseWriter()
+	if c := w.(ConnInfo); c.RemoteAddr() != nil || c.LocalAddr() != nil || c.Network() != "" || c.TsigStatus() != ErrNoConn {
+		t.Errorf("unexpected connection of a standalone writer")
+	}
+	if hijack(w) != nil || isHijacked(w) {
+		t.Errorf("unexpected hijacking of a standalone writer")
+	}
+
+	// a wrapper without optional interfaces
+	wrapper := struct{ ResponseWriter }{w}
+	if remoteAddr(wrapper) != nil || connNetwork(wrapper) != "" || tsigStatus(wrapper) != ErrNoConn {
+		t.Errorf("unexpected connection of a wrapper")
+	}
+	if hijack(wrapper) != nil || isHijacked(wrapper) {
+		t.Errorf("unexpected hijacking of a wrapper")
+	}
+}
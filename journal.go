@@ -0,0 +1,204 @@
+package dnsrouter
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultMaxJournal is the default number of changes kept per zone for IXFR.
+const DefaultMaxJournal = 100
+
+type journalKey struct {
+	origin string // lower-cased FQDN
+	qclass uint16
+}
+
+func newJournalKey(origin string, qclass uint16) journalKey {
+	return journalKey{strings.ToLower(dns.Fqdn(origin)), qclass}
+}
+
+// journalEntry is a change of zone from one serial to another, an entry
+// without from marks the zone changed without a new serial.
+type journalEntry struct {
+	from, to       *dns.SOA
+	removed, added []dns.RR
+}
+
+type zoneChange struct {
+	removed, added []dns.RR
+}
+
+// recordChange records a change of the handler into the zone of its origin,
+// or the zone of apex if the handler has no origin.
+func (t *txn) recordChange(qclass uint16, apex string, h typeHandler, added bool) {
+	a, ok := h.Handler.(Answer)
+	if !ok {
+		return
+	}
+
+	origin := h.Origin
+	if origin == "" {
+		origin = apex
+	}
+	if origin == "" {
+		return
+	}
+
+	key := newJournalKey(origin, qclass)
+	if t.changes == nil {
+		t.changes = make(map[journalKey]*zoneChange)
+	}
+	change := t.changes[key]
+	if change == nil {
+		change = new(zoneChange)
+		t.changes[key] = change
+	}
+
+	if added {
+		change.added = append(change.added, a.RR)
+	} else {
+		change.removed = append(change.removed, a.RR)
+	}
+}
+
+// recordRemoval returns a filter like f which records removed handlers as well.
+func (t *txn) recordRemoval(qclass uint16, apex string, f func(typeHandler) bool) func(typeHandler) bool {
+	return func(h typeHandler) bool {
+		if !f(h) {
+			return false
+		}
+		t.recordChange(qclass, apex, h, false)
+		return true
+	}
+}
+
+// apexOf returns the nearest zone apex enclosing the name, or "" if no such zone.
+func (t *txn) apexOf(name string, qclass uint16) string {
+	root := t.trees[qclass]
+	if root == nil {
+		return ""
+	}
+
+	name = dns.Fqdn(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if nodeSOA(root, name[off:]) != nil {
+			return name[off:]
+		}
+	}
+	return ""
+}
+
+// nextJournals returns the journals appended with changes made by t upon old trees.
+// A zone of which the serial is not increased, e.g. changed by Handle without
+// a new SOA, loses its journal, since changes are no longer identified by serials.
+// So does the next change of the zone, which starts from an unidentified version.
+func (r *Router) nextJournals(old map[uint16]*node, t *txn) map[journalKey][]journalEntry {
+	max := r.MaxJournal
+	if max == 0 {
+		max = DefaultMaxJournal
+	}
+
+	current := r.loadJournals()
+	journals := make(map[journalKey][]journalEntry, len(current))
+	for k, v := range current {
+		journals[k] = v
+	}
+
+	for key, change := range t.changes {
+		from := nodeSOA(old[key.qclass], key.origin)
+		to := nodeSOA(t.trees[key.qclass], key.origin)
+		added, removed := diffRecords(change.removed, change.added)
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		if max < 0 || from == nil || to == nil {
+			delete(journals, key)
+			continue
+		}
+		if !serialGreater(to.Serial, from.Serial) {
+			journals[key] = []journalEntry{{to: to}}
+			continue
+		}
+
+		entries := journals[key]
+		if len(entries) > 0 && entries[len(entries)-1].from == nil {
+			delete(journals, key)
+			continue
+		}
+		entries = append(entries[:len(entries):len(entries)], journalEntry{
+			from:    from,
+			to:      to,
+			removed: withoutSOA(removed, key.origin),
+			added:   withoutSOA(added, key.origin),
+		})
+		if len(entries) > max {
+			entries = entries[len(entries)-max:]
+		}
+		journals[key] = entries
+	}
+	return journals
+}
+
+func (r *Router) loadJournals() map[journalKey][]journalEntry {
+	journals, _ := r.journals.Load().(map[journalKey][]journalEntry)
+	return journals
+}
+
+// zoneSOA returns the SOA of the zone whose apex is the name, or nil if no such zone.
+func (r *Router) zoneSOA(name string, qclass uint16) *dns.SOA {
+	return nodeSOA(r.loadTrees()[qclass], name)
+}
+
+// ixfr returns the changes of the zone since the serial in the format of IXFR
+// (https://tools.ietf.org/html/rfc1995#section-4), without the leading and
+// trailing current SOA. It reports false if the journal doesn't cover the serial.
+func (r *Router) ixfr(name string, qclass uint16, serial uint32) ([]dns.RR, bool) {
+	soa := r.zoneSOA(name, qclass)
+	entries := r.loadJournals()[newJournalKey(name, qclass)]
+	if soa == nil || len(entries) == 0 || entries[len(entries)-1].to.Serial != soa.Serial {
+		return nil, false
+	}
+
+	for i, entry := range entries {
+		if entry.from == nil || entry.from.Serial != serial {
+			continue
+		}
+
+		var rrs []dns.RR
+		for _, entry := range entries[i:] {
+			rrs = append(rrs, entry.from)
+			rrs = append(rrs, entry.removed...)
+			rrs = append(rrs, entry.to)
+			rrs = append(rrs, entry.added...)
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+// nodeSOA returns the SOA served by Answer at the name, or nil if not found.
+func nodeSOA(root *node, name string) *dns.SOA {
+	if root == nil {
+		return nil
+	}
+
+	n := root.findRoute(newIndexableName(name))
+	if n == nil || n.data == nil {
+		return nil
+	}
+	return findSOA(answerRecords(n.data.handler, nil), name)
+}
+
+// withoutSOA returns records except the SOA owned by the origin.
+func withoutSOA(rrs []dns.RR, origin string) []dns.RR {
+	l := rrs[:0:0]
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok && equalName(soa.Hdr.Name, origin) {
+			continue
+		}
+		l = append(l, rr)
+	}
+	return l
+}
@@ -0,0 +1,127 @@
+package dnsrouter
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NotifyHandler returns a handler of NOTIFY requests (https://tools.ietf.org/html/rfc1996),
+// which should be registered into Router.OpcodeHandler with dns.OpcodeNotify.
+// A NOTIFY of the zone of any given Secondary makes it refresh immediately,
+// as long as the request comes from the IP address of its primary. Other requests
+// are responded with NOTAUTH if the zone is unknown, or REFUSED if not from the primary.
+func NotifyHandler(secondaries ...*Secondary) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		result := w.Msg()
+		if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+			result.Rcode = dns.RcodeFormatError
+			return
+		}
+
+		remote := addrIP(remoteAddr(w))
+
+		rcode := dns.RcodeNotAuth
+		for _, s := range secondaries {
+			if !equalName(s.Origin, req.Question[0].Name) {
+				continue
+			}
+
+			host, _, err := net.SplitHostPort(s.Primary)
+			if err != nil || remote == nil || !remote.Equal(net.ParseIP(host)) {
+				rcode = dns.RcodeRefused
+				continue
+			}
+
+			s.Notify()
+			rcode = dns.RcodeSuccess
+			break
+		}
+
+		result.Rcode = rcode
+		result.Authoritative = rcode == dns.RcodeSuccess
+	})
+}
+
+// DefaultNotifyRetries is the default number of retransmissions of a NOTIFY.
+const DefaultNotifyRetries = 5
+
+// A Notifier sends NOTIFY messages to secondaries of a zone, it is usually
+// chained with a Router as
+//
+//	router.OnZoneChange = notifier.Notify
+type Notifier struct {
+	// Secondaries are addresses of secondaries keyed by origin, e.g.
+	//	map[string][]string{"example.org.": {"192.0.2.2:53"}}
+	Secondaries map[string][]string
+
+	// Retries is the number of retransmissions if a secondary doesn't respond,
+	// if it is zero, then uses DefaultNotifyRetries.
+	Retries int
+
+	// Timeout of each transmission, if it is zero, then uses the default of dns.Client.
+	Timeout time.Duration
+
+	// OnNotify is called after notifying a secondary if it is not nil, with
+	// an error if failed.
+	OnNotify func(origin, addr string, err error)
+
+	wg sync.WaitGroup
+}
+
+// Notify sends NOTIFY messages of the origin to its secondaries asynchronously.
+func (n *Notifier) Notify(origin string) {
+	for k, addrs := range n.Secondaries {
+		if !equalName(k, origin) {
+			continue
+		}
+
+		for _, addr := range addrs {
+			n.wg.Add(1)
+			go func(addr string) {
+				defer n.wg.Done()
+
+				err := n.notify(dns.Fqdn(origin), addr)
+				if n.OnNotify != nil {
+					n.OnNotify(origin, addr, err)
+				}
+			}(addr)
+		}
+	}
+}
+
+// Wait waits for all pending notifications.
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+func (n *Notifier) notify(origin, addr string) error {
+	retries := n.Retries
+	if retries <= 0 {
+		retries = DefaultNotifyRetries
+	}
+
+	m := new(dns.Msg)
+	m.SetNotify(origin)
+	c := &dns.Client{Timeout: n.Timeout}
+
+	var err error
+	for i := 0; i <= retries; i++ {
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(m, addr)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			return err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("%s: NOTIFY %s failed: %s", addr, origin, dns.RcodeToString[resp.Rcode])
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package dnsrouter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nsec3Index is a hash-ordered index of NSEC3 records of a zone, which is
+// built upon the NSEC3PARAM of the zone apex.
+type nsec3Index struct {
+	hash       uint8
+	iterations uint16
+	salt       string
+
+	// hashes are upper-cased hashed owner labels in order
+	hashes []string
+	// handlers are handlers of the hashed owners
+	handlers []classHandler
+}
+
+// newNsec3Index returns an index of NSEC3 records of the zone, or nil if the
+// zone has no NSEC3PARAM.
+func newNsec3Index(apex *node, origin string) *nsec3Index {
+	var param *dns.NSEC3PARAM
+	for _, rr := range answerRecords(apex.data.handler.Search(dns.TypeNSEC3PARAM), nil) {
+		if v := rr.(*dns.NSEC3PARAM); v.Flags == 0 {
+			param = v
+			break
+		}
+	}
+	if param == nil {
+		return nil
+	}
+
+	x := &nsec3Index{
+		hash:       param.Hash,
+		iterations: param.Iterations,
+		salt:       strings.ToUpper(param.Salt),
+	}
+	apex.walk(func(n *node) {
+		if n.data == nil {
+			return
+		}
+		for _, rr := range answerRecords(n.data.handler.Search(dns.TypeNSEC3), nil) {
+			nsec3 := rr.(*dns.NSEC3)
+			if nsec3.Hash != x.hash || nsec3.Iterations != x.iterations || !strings.EqualFold(nsec3.Salt, x.salt) {
+				continue
+			}
+
+			name := nsec3.Hdr.Name
+			off, end := dns.NextLabel(name, 0)
+			if end || !equalName(name[off:], origin) {
+				continue
+			}
+			x.hashes = append(x.hashes, strings.ToUpper(name[:off-1]))
+			x.handlers = append(x.handlers, n.data.handler)
+			break
+		}
+	})
+	sort.Sort(x)
+	return x
+}
+
+func (x *nsec3Index) Len() int {
+	return len(x.hashes)
+}
+
+func (x *nsec3Index) Less(a, b int) bool {
+	return x.hashes[a] < x.hashes[b]
+}
+
+func (x *nsec3Index) Swap(a, b int) {
+	x.hashes[a], x.hashes[b] = x.hashes[b], x.hashes[a]
+	x.handlers[a], x.handlers[b] = x.handlers[b], x.handlers[a]
+}
+
+// search returns handlers of the hashed owner which matches or covers the name.
+func (x *nsec3Index) search(name string) classHandler {
+	if x == nil || len(x.hashes) == 0 {
+		return nil
+	}
+
+	hash := dns.HashName(name, x.hash, x.iterations, x.salt)
+	if hash == "" {
+		return nil
+	}
+
+	i := sort.SearchStrings(x.hashes, hash)
+	if i < len(x.hashes) && x.hashes[i] == hash {
+		return x.handlers[i]
+	}
+	if i == 0 {
+		// the last one covers names hashed before the first one
+		i = len(x.hashes)
+	}
+	return x.handlers[i-1]
+}
+
+// indexNsec3 rebuilds NSEC3 indices of changed zones.
+func (t *txn) indexNsec3() {
+	for key := range t.changes {
+		if !t.copied[key.qclass] {
+			continue
+		}
+
+		path := t.nodes.ownRoute(t.trees[key.qclass], newIndexableName(key.origin))
+		if path == nil {
+			continue
+		}
+		if apex := path[len(path)-1]; apex.data != nil {
+			apex.data.nsec3 = newNsec3Index(apex, key.origin)
+		}
+	}
+}
+
+// nsec3Prover collects NSEC3 proofs (https://tools.ietf.org/html/rfc5155#section-7.2).
+type nsec3Prover struct {
+	w    ResponseWriter
+	req  *Request
+	stub Stub
+
+	seen map[string]bool
+	rrs  []dns.RR
+}
+
+// lookup returns the NSEC3 which matches or covers the name, as well as
+// records owned by the NSEC3 including signatures.
+func (p *nsec3Prover) lookup(name string) (*dns.NSEC3, []dns.RR) {
+	class := p.stub.Lookup(name, p.req.Question[0].Qclass).NextSecure(dns.TypeNSEC3)
+	if class == nil {
+		return nil, nil
+	}
+
+	var nsec3Sig Handler
+	if nsec3Rrsig, ok := class.Search(dns.TypeRRSIG).(Class); ok {
+		nsec3Sig = nsec3Rrsig.Search(dns.TypeNSEC3)
+	}
+
+	m := FurtherRequest(p.w, p.req, name, dns.TypeNSEC3, MultiHandler(class.Search(dns.TypeNSEC3), nsec3Sig))
+	if i := First(m.Answer, dns.TypeNSEC3); i != -1 {
+		return m.Answer[i].(*dns.NSEC3), m.Answer
+	}
+	return nil, nil
+}
+
+// add adds records of the NSEC3 unless already added.
+func (p *nsec3Prover) add(nsec3 *dns.NSEC3, rrs []dns.RR) {
+	if nsec3 == nil {
+		return
+	}
+
+	owner := strings.ToLower(nsec3.Hdr.Name)
+	if p.seen == nil {
+		p.seen = make(map[string]bool)
+	}
+	if !p.seen[owner] {
+		p.seen[owner] = true
+		p.rrs = append(p.rrs, rrs...)
+	}
+}
+
+// closestEncloser adds the NSEC3 matching the closest encloser of the name,
+// and the NSEC3 covering the next closer name if the name doesn't exist.
+// It returns the closest encloser, or "" if not proved.
+func (p *nsec3Prover) closestEncloser(name string) string {
+	var (
+		next    *dns.NSEC3
+		nextRRs []dns.RR
+	)
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		nsec3, rrs := p.lookup(name[off:])
+		if nsec3 == nil {
+			break
+		}
+		if nsec3.Match(name[off:]) {
+			p.add(nsec3, rrs)
+			p.add(next, nextRRs)
+			return name[off:]
+		}
+		next, nextRRs = nsec3, rrs
+	}
+	return ""
+}
+
+// nextCloser adds the NSEC3 covering the next closer name of the name to the
+// closest encloser.
+func (p *nsec3Prover) nextCloser(name, closestEncloser string) {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(closestEncloser) + 1
+	if len(labels) < n {
+		return
+	}
+	p.add(p.lookup(dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))))
+}
+
+// nsec3Proofs fills out NSEC3 records proving the response.
+func nsec3Proofs(w ResponseWriter, req *Request, stub Stub) {
+	var (
+		qname  = req.Question[0].Name
+		qtype  = req.Question[0].Qtype
+		result = w.Msg()
+		p      = &nsec3Prover{w: w, req: req, stub: stub}
+	)
+
+	if i := FirstAny(result.Answer, dns.TypeCNAME, qtype); i != -1 {
+		// wildcard answer
+		if owner := result.Answer[i].Header().Name; strings.HasPrefix(owner, "*.") {
+			p.nextCloser(qname, owner[2:])
+		}
+	} else if i := First(result.Ns, dns.TypeNS); i != -1 {
+		// referral to an unsigned zone, which might be opted out
+		if !Exists(result.Ns, dns.TypeDS) {
+			p.closestEncloser(result.Ns[i].Header().Name)
+		}
+	} else if result.Rcode == dns.RcodeNameError {
+		if ce := p.closestEncloser(qname); ce != "" {
+			p.add(p.lookup("*." + ce))
+		}
+	} else if result.Rcode == dns.RcodeSuccess {
+		if ce := p.closestEncloser(qname); ce != "" && ce != qname && qtype != dns.TypeDS {
+			// wildcard no data
+			p.add(p.lookup("*." + ce))
+		}
+	}
+
+	result.Ns = append(result.Ns, p.rrs...)
+}
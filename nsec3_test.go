@@ -0,0 +1,147 @@
+package dnsrouter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestNsec3Zone returns an opt-out NSEC3 signed zone with records, in which
+// names are hashed with NSEC3 records and fake signatures.
+func newTestNsec3Zone(origin string, names []string, records ...string) string {
+	const salt = "ABCD"
+
+	hashes := make([]string, len(names))
+	for i, name := range names {
+		hashes[i] = dns.HashName(name, dns.SHA1, 1, salt)
+	}
+	sort.Strings(hashes)
+
+	records = append(records, fmt.Sprintf("@ 3600 IN NSEC3PARAM 1 0 1 %s", salt))
+	for i, hash := range hashes {
+		next := hashes[(i+1)%len(hashes)]
+		records = append(records,
+			fmt.Sprintf("%s 3600 IN NSEC3 1 1 1 %s %s A RRSIG", hash, salt, next),
+			fmt.Sprintf("%s 3600 IN RRSIG NSEC3 8 3 3600 20300101000000 20200101000000 12345 %s AAAA", hash, origin))
+	}
+	return newTestZone(origin, 1, records...)
+}
+
+func TestLookupNsec3(t *testing.T) {
+	zone := newTestNsec3Zone("example.org.",
+		[]string{"example.org.", "a.example.org.", "c.example.org.", "b.c.example.org.", "w.example.org.", "*.w.example.org."},
+		"@ 3600 IN NS ns.example.org.",
+		"a 3600 IN A 127.0.0.1",
+		"b.c 3600 IN A 127.0.0.2",
+		"*.w 3600 IN A 127.0.0.3",
+		"sub 3600 IN NS ns.sub.example.org.",
+		"ns.sub 3600 IN A 127.0.0.4",
+	)
+
+	router := New()
+	router.HandleZone(strings.NewReader(zone), "example.org.", "stdin")
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer int
+		// match and cover are names proved by NSEC3 records
+		match, cover []string
+	}{
+		// no data
+		{"a.example.org.", dns.TypeAAAA, dns.RcodeSuccess, 0, []string{"a.example.org."}, nil},
+		// empty non-terminal
+		{"c.example.org.", dns.TypeA, dns.RcodeSuccess, 0, []string{"c.example.org."}, nil},
+		// name error
+		{"x.a.example.org.", dns.TypeA, dns.RcodeNameError, 0,
+			[]string{"a.example.org."}, []string{"x.a.example.org.", "*.a.example.org."}},
+		{"x.y.c.example.org.", dns.TypeA, dns.RcodeNameError, 0,
+			[]string{"c.example.org."}, []string{"y.c.example.org.", "*.c.example.org."}},
+		// wildcard answer
+		{"x.y.w.example.org.", dns.TypeA, dns.RcodeSuccess, 1, nil, []string{"y.w.example.org."}},
+		// wildcard no data
+		{"x.w.example.org.", dns.TypeAAAA, dns.RcodeSuccess, 0,
+			[]string{"w.example.org.", "*.w.example.org."}, []string{"x.w.example.org."}},
+		// opt-out delegation
+		{"www.sub.example.org.", dns.TypeA, dns.RcodeSuccess, 0,
+			[]string{"example.org."}, []string{"sub.example.org."}},
+		{"sub.example.org.", dns.TypeDS, dns.RcodeSuccess, 0,
+			[]string{"example.org."}, []string{"sub.example.org."}},
+	}
+
+	for i, test := range tests {
+		req := NewRequest(test.qname, test.qtype)
+		req.SetEdns0(4096, true)
+		w := NewResponseWriter()
+		router.ServeDNS(w, req)
+
+		m := w.Msg()
+		if m.Rcode != test.rcode || len(m.Answer) != test.answer {
+			t.Errorf("%d: unexpected response: %v", i, m)
+			continue
+		}
+
+		var nsec3s []*dns.NSEC3
+		var sigs int
+		for _, rr := range m.Ns {
+			switch rr := rr.(type) {
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			case *dns.RRSIG:
+				if rr.TypeCovered == dns.TypeNSEC3 {
+					sigs++
+				}
+			}
+		}
+		if len(nsec3s) == 0 || sigs != len(nsec3s) {
+			t.Errorf("%d: unexpected proofs: %v", i, m.Ns)
+			continue
+		}
+		if n := len(test.match) + len(test.cover); len(nsec3s) > n {
+			t.Errorf("%d: expected no more than %d NSEC3, got %d", i, n, len(nsec3s))
+		}
+
+		for _, name := range test.match {
+			var ok bool
+			for _, nsec3 := range nsec3s {
+				ok = ok || nsec3.Match(name)
+			}
+			if !ok {
+				t.Errorf("%d: missing NSEC3 matching %s", i, name)
+			}
+		}
+		for _, name := range test.cover {
+			var ok bool
+			for _, nsec3 := range nsec3s {
+				ok = ok || nsec3.Cover(name)
+			}
+			if !ok {
+				t.Errorf("%d: missing NSEC3 covering %s", i, name)
+			}
+		}
+	}
+
+	// no proofs without DO
+	req := NewRequest("x.a.example.org.", dns.TypeA)
+	w := NewResponseWriter()
+	router.ServeDNS(w, req)
+	if Exists(w.Msg().Ns, dns.TypeNSEC3) {
+		t.Errorf("unexpected NSEC3: %v", w.Msg().Ns)
+	}
+
+	// the index follows changes of the zone
+	router.RemoveZone("example.org.")
+	router.HandleZone(strings.NewReader(newTestNsec3Zone("example.org.",
+		[]string{"example.org.", "x.a.example.org."}, "x.a 3600 IN A 127.0.0.5")), "example.org.", "stdin")
+	req = NewRequest("x.a.example.org.", dns.TypeAAAA)
+	req.SetEdns0(4096, true)
+	w = NewResponseWriter()
+	router.ServeDNS(w, req)
+	if i := First(w.Msg().Ns, dns.TypeNSEC3); i == -1 || !w.Msg().Ns[i].(*dns.NSEC3).Match("x.a.example.org.") {
+		t.Errorf("unexpected proofs: %v", w.Msg().Ns)
+	}
+}
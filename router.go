@@ -2,21 +2,44 @@ package dnsrouter
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
 
 // Router is a dns Handler which can be used to dispatch requests to different
 // handler functions via configurable routes.
+// Routes could be registered at any time, even if the Router is serving, a change
+// is made upon a copy of trees and swapped in atomically, lookups are never blocked
+// and always see either the whole change or nothing of it.
 type Router struct {
-	trees map[uint16]*node
+	mu       sync.Mutex   // serializes writers
+	trees    atomic.Value // map[uint16]*node, never modified once stored
+	journals atomic.Value // map[journalKey][]journalEntry, never modified once stored
 
 	// Configurable middleware that chaining with the Router.
 	// If it is nil, then uses DefaultScheme.
 	Middleware []Middleware
+
+	// MaxJournal is the maximum number of changes kept per zone for IXFR.
+	// If it is zero, then uses DefaultMaxJournal, a negative value disables journaling.
+	MaxJournal int
+
+	// OpcodeHandler serves requests of opcodes other than QUERY, keyed by opcode,
+	// without chaining Middleware but PanicHandler. A request of an opcode
+	// without handler is responded with NOTIMP.
+	OpcodeHandler map[int]Handler
+
+	// OnZoneChange is called with the origin after the serial of a zone is
+	// changed, if it is not nil. It is called synchronously after the change is
+	// published, so it could make further changes upon the Router.
+	OnZoneChange func(origin string)
 }
 
 // Making sure the Router conforms with the dns.Handler interface.
@@ -24,9 +47,10 @@ var _ Handler = new(Router)
 
 // New returns a new initialized Router.
 func New() *Router {
-	return &Router{
-		trees: make(map[uint16]*node),
-	}
+	r := new(Router)
+	r.trees.Store(make(map[uint16]*node))
+	r.journals.Store(make(map[journalKey][]journalEntry))
+	return r
 }
 
 // Handle registers a new request handler with a routing pattern, any string that
@@ -39,29 +63,20 @@ func New() *Router {
 // Please pay attention that Handle won't check if the given string contains an actual
 // record data, e.g. "github.com A" is legal to pass to Handle, so calling
 // Handle("github.com A", nil) causes a strange RR "github.com. 3600 IN A " in ANSWER section.
+// Since every call copies the tree of the class, loading records in bulk with HandleZone
+// is much cheaper than calling Handle repeatedly.
 func (r *Router) Handle(s string, handler Handler) {
 	rr, err := dns.NewRR(s)
 	if err != nil {
 		panic(err)
 	}
-	if handler == nil {
-		handler = Answer{rr}
-	}
-
 	if rr == nil {
 		panic("nil RR: " + s)
 	}
 
-	hdr := rr.Header()
-
-	var typeCovered uint16
-	if hdr.Rrtype == dns.TypeRRSIG {
-		typeCovered = rr.(*dns.RRSIG).TypeCovered
-	}
-	r.handle(hdr.Name, hdr.Class, typeHandler{
-		Qtype:       hdr.Rrtype,
-		TypeCovered: typeCovered,
-		Handler:     handler,
+	r.update(func(t *txn) error {
+		t.handle(rr.Header().Name, rr.Header().Class, newTypeHandler("", rr, handler))
+		return nil
 	})
 }
 
@@ -70,40 +85,242 @@ func (r *Router) HandleFunc(s string, handlerFunc HandlerFunc) {
 	r.Handle(s, handlerFunc)
 }
 
-// HandleZoneFile loads a zone file.
+// HandleZoneFile loads a zone file, it panics if LoadZoneFile fails.
 func (r *Router) HandleZoneFile(origin, filename string) {
+	if err := r.LoadZoneFile(origin, filename); err != nil {
+		panic(err)
+	}
+}
+
+// HandleZone loads a zone reader, it panics if LoadZone fails.
+func (r *Router) HandleZone(f io.Reader, origin, filename string) {
+	if err := r.LoadZone(f, origin, filename); err != nil {
+		panic(err)
+	}
+}
+
+// LoadZoneFile loads a zone file, see LoadZone for details.
+func (r *Router) LoadZoneFile(origin, filename string) error {
 	f, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer f.Close()
 
-	r.HandleZone(f, origin, path.Base(filename))
+	return r.LoadZone(f, origin, path.Base(filename))
 }
 
-// HandleZone loads a zone reader.
-func (r *Router) HandleZone(f io.Reader, origin, filename string) {
-	for x := range dns.ParseZone(f, dns.Fqdn(origin), filename) {
-		if x.Error != nil {
-			panic(x.Error)
+// LoadZone loads a zone reader transactionally, the whole zone becomes visible
+// at once, or the Router is left untouched if any record fails to load. In the
+// latter case, a *ZoneError is returned.
+func (r *Router) LoadZone(f io.Reader, origin, filename string) error {
+	return r.update(func(t *txn) error {
+		return t.loadZone(f, origin, filename)
+	})
+}
+
+// ZoneError is returned by LoadZone if a zone is rejected.
+type ZoneError struct {
+	Origin string
+
+	// Errors consists of either the parsing error, which comes with the file name
+	// and line number, or every error occurred while registering records.
+	// Since the parser stops at the first malformed record, there is at most
+	// one parsing error.
+	Errors []error
+}
+
+func (e *ZoneError) Error() string {
+	s := e.Origin + ": " + e.Errors[0].Error()
+	if n := len(e.Errors) - 1; n > 0 {
+		s += fmt.Sprintf(" (and %d more errors)", n)
+	}
+	return s
+}
+
+// Remove unregisters handlers of the qtype from a routing pattern, which is
+// matched literally as the name given to Handle, i.e. "*.example.org" removes the
+// wildcard rather than any name it covers. The dns.TypeANY removes all handlers
+// of the name, and the dns.TypeRRSIG removes signatures covering any type.
+// It reports whether any handler has been removed.
+func (r *Router) Remove(name string, qclass, qtype uint16) bool {
+	var removed int
+	r.update(func(t *txn) error {
+		removed = t.remove(name, qclass, func(h typeHandler) bool {
+			return qtype == dns.TypeANY || h.Qtype == qtype
+		})
+		return nil
+	})
+	return removed > 0
+}
+
+// RemoveZone unregisters all records loaded by HandleZone or HandleZoneFile with the origin,
+// from every class. It reports whether any record has been removed.
+func (r *Router) RemoveZone(origin string) bool {
+	var removed int
+	r.update(func(t *txn) error {
+		removed = t.removeZone(origin)
+		return nil
+	})
+	return removed > 0
+}
+
+// update runs fn against a copy of trees, then publishes the copy if fn succeeds.
+// Nothing is published if fn returns an error or panics.
+func (r *Router) update(fn func(t *txn) error) error {
+	changed, err := r.commit(fn)
+	if err == nil && r.OnZoneChange != nil {
+		for _, origin := range changed {
+			r.OnZoneChange(origin)
 		}
+	}
+	return err
+}
 
-		rr := x.RR
+// commit is like update, but returns origins of which the serial is changed
+// instead of calling OnZoneChange.
+func (r *Router) commit(fn func(t *txn) error) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.loadTrees()
+	t := &txn{trees: old}
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+	t.indexNsec3()
+	if t.copied != nil {
+		r.trees.Store(t.trees)
+	}
+	if t.changes == nil {
+		return nil, nil
+	}
+
+	r.journals.Store(r.nextJournals(old, t))
+
+	var changed []string
+	for key := range t.changes {
+		from := nodeSOA(old[key.qclass], key.origin)
+		to := nodeSOA(t.trees[key.qclass], key.origin)
+		if to != nil && (from == nil || from.Serial != to.Serial) {
+			changed = append(changed, key.origin)
+		}
+	}
+	return changed, nil
+}
+
+func (r *Router) loadTrees() map[uint16]*node {
+	trees, _ := r.trees.Load().(map[uint16]*node)
+	return trees
+}
+
+// txn is a pending change of trees. Nodes are copied upon first written, so
+// neither the published map nor the published trees are ever modified.
+type txn struct {
+	trees  map[uint16]*node
+	copied map[uint16]bool
+
+	// nodes are created or copied by the transaction
+	nodes cow
+
+	// changes are records served by Answer added into or removed from zones
+	changes map[journalKey]*zoneChange
+}
+
+// tree returns a writable tree of the class, creates one if create is set,
+// otherwise it returns nil if no such tree.
+func (t *txn) tree(qclass uint16, create bool) *node {
+	if t.copied[qclass] {
+		return t.trees[qclass]
+	}
+
+	if t.nodes == nil {
+		t.nodes = make(cow)
+	}
+	root := t.trees[qclass]
+	if root != nil {
+		root = t.nodes.own(root)
+	} else if create {
+		root = t.nodes.mark(new(node))
+	} else {
+		return nil
+	}
+
+	trees := make(map[uint16]*node, len(t.trees)+1)
+	for k, v := range t.trees {
+		trees[k] = v
+	}
+	trees[qclass] = root
+	t.trees = trees
+
+	if t.copied == nil {
+		t.copied = make(map[uint16]bool)
+	}
+	t.copied[qclass] = true
+	return root
+}
+
+// tryHandle is like handle, but returns an error instead of panicking.
+func (t *txn) tryHandle(name string, qclass uint16, handler typeHandler) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if e, ok := v.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%v", v)
+			}
+		}
+	}()
+
+	t.handle(name, qclass, handler)
+	return nil
+}
+
+func (t *txn) loadZone(f io.Reader, origin, filename string) error {
+	rrs, err := parseZone(f, origin, filename)
+	if err != nil {
+		return err
+	}
+	return t.loadRecords(rrs, origin, filename)
+}
+
+// loadRecords registers records of the origin, it returns a *ZoneError if any record fails.
+func (t *txn) loadRecords(rrs []dns.RR, origin, filename string) error {
+	var errs []error
+	for _, rr := range rrs {
 		hdr := rr.Header()
+		if err := t.tryHandle(hdr.Name, hdr.Class, newTypeHandler(origin, rr, nil)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %v", filename, rr, err))
+		}
+	}
+
+	if errs != nil {
+		return &ZoneError{Origin: dns.Fqdn(origin), Errors: errs}
+	}
+	return nil
+}
 
-		var typeCovered uint16
-		if hdr.Rrtype == dns.TypeRRSIG {
-			typeCovered = rr.(*dns.RRSIG).TypeCovered
+// parseZone reads all records from a zone reader, it returns a *ZoneError if
+// the zone is malformed.
+func parseZone(f io.Reader, origin, filename string) ([]dns.RR, error) {
+	var (
+		rrs []dns.RR
+		err error
+	)
+	for x := range dns.ParseZone(f, dns.Fqdn(origin), filename) {
+		if x.Error != nil {
+			// keep draining so that the parser goroutine could exit
+			if err == nil {
+				err = &ZoneError{Origin: dns.Fqdn(origin), Errors: []error{x.Error}}
+			}
+			continue
 		}
-		r.handle(hdr.Name, hdr.Class, typeHandler{
-			Origin:      origin,
-			Qtype:       hdr.Rrtype,
-			TypeCovered: typeCovered,
-			Handler:     Answer{rr},
-		})
+		rrs = append(rrs, x.RR)
 	}
+	return rrs, err
 }
 
-func (r *Router) handle(name string, qclass uint16, handler typeHandler) {
+func (t *txn) handle(name string, qclass uint16, handler typeHandler) {
 	if name == "" || len(name) > 1 && isIndexable(name) {
 		panic(name + ": illegal domain")
 	}
@@ -111,22 +328,66 @@ func (r *Router) handle(name string, qclass uint16, handler typeHandler) {
 		panic(name + ": missing Handler")
 	}
 
-	root := r.trees[qclass]
+	indexableName := newIndexableName(name)
+	t.nodes.addRoute(t.tree(qclass, true), indexableName, true, handler)
+	if handler.Origin == "" {
+		t.recordChange(qclass, t.apexOf(name, qclass), handler, true)
+	} else {
+		t.recordChange(qclass, "", handler, true)
+	}
+}
+
+func (t *txn) remove(name string, qclass uint16, f func(typeHandler) bool) int {
+	if name == "" || len(name) > 1 && isIndexable(name) {
+		panic(name + ": illegal domain")
+	}
+
+	root := t.tree(qclass, false)
 	if root == nil {
-		root = new(node)
-		r.trees[qclass] = root
+		return 0
 	}
+	return t.nodes.removeRoute(root, newIndexableName(name), t.recordRemoval(qclass, t.apexOf(name, qclass), f))
+}
 
-	indexableName := newIndexableName(name)
-	root.addRoute(indexableName, true, handler)
+func (t *txn) removeZone(origin string) int {
+	f := func(h typeHandler) bool {
+		return h.Origin != "" && equalName(h.Origin, origin)
+	}
+
+	var removed int
+	for qclass := range t.trees {
+		var names []string
+		root := t.trees[qclass]
+		root.walkName(root.name, func(name string, n *node) {
+			if n.data == nil {
+				return
+			}
+			for _, h := range n.data.handler {
+				if f(h) {
+					names = append(names, name)
+					break
+				}
+			}
+		})
+		if names == nil {
+			continue
+		}
+
+		root = t.tree(qclass, false)
+		for _, name := range names {
+			removed += t.nodes.removeRoute(root, name, t.recordRemoval(qclass, "", f))
+		}
+	}
+	return removed
 }
 
 // Lookup implements Stub interface, this method would never return nil.
 func (r *Router) Lookup(name string, qclass uint16) Class {
 	var c basicClass
+	c.name = dns.Fqdn(name)
 	c.stub = r
 
-	if root := r.trees[qclass]; root != nil {
+	if root := r.loadTrees()[qclass]; root != nil {
 		c.value = root.getValue(newIndexableName(name))
 		c.value.revertParams()
 		c.params = c.value.params
@@ -140,8 +401,23 @@ func (r *Router) Lookup(name string, qclass uint16) Class {
 
 // ServeDNS implements Handler interface.
 func (r *Router) ServeDNS(resp ResponseWriter, req *Request) {
+	if req.Opcode != dns.OpcodeQuery && len(req.Question) == 0 {
+		// there is no zone to look up for opcode handlers
+		RcodeHandler(dns.RcodeFormatError).ServeDNS(resp, req)
+		return
+	}
+
 	class := r.Lookup(req.Question[0].Name, req.Question[0].Qclass)
 	ctx := context.WithValue(req.Context(), ClassContextKey, class)
+	if req.Opcode != dns.OpcodeQuery {
+		h := r.OpcodeHandler[req.Opcode]
+		if h == nil {
+			h = RcodeHandler(dns.RcodeNotImplemented)
+		}
+		PanicHandler(h).ServeDNS(resp, req.WithContext(ctx))
+		return
+	}
+
 	middleware := r.Middleware
 	if middleware == nil {
 		middleware = DefaultScheme
@@ -149,6 +425,30 @@ func (r *Router) ServeDNS(resp ResponseWriter, req *Request) {
 	ChainHandler(NoErrorHandler, middleware...).ServeDNS(resp, req.WithContext(ctx))
 }
 
+// newTypeHandler returns a typeHandler serving the RR, if h is nil then Answer is used.
+func newTypeHandler(origin string, rr dns.RR, h Handler) typeHandler {
+	if h == nil {
+		h = Answer{rr}
+	}
+
+	var typeCovered uint16
+	if rrsig, ok := rr.(*dns.RRSIG); ok {
+		typeCovered = rrsig.TypeCovered
+	}
+	return typeHandler{
+		Origin:      origin,
+		Qtype:       rr.Header().Rrtype,
+		TypeCovered: typeCovered,
+		Handler:     h,
+	}
+}
+
+// equalName reports whether two domain names are equal, regardless of letter case
+// and the trailing dot.
+func equalName(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
 func newIndexableName(name string) string {
 	if !isIndexable(name) {
 		name = indexable(dns.Fqdn(name))
@@ -13,6 +13,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -248,6 +249,223 @@ func TestRouterLookup(t *testing.T) {
 	}
 }
 
+func TestRouterConcurrentHandle(t *testing.T) {
+	const n = 200
+
+	router := New()
+	router.Handle("example.org SOA ns.example.org. admin.example.org. 1 3600 600 86400 300", nil)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for j := 0; j < n; j += 10 {
+					resp := new(responseWriter)
+					router.ServeDNS(resp, NewRequest(fmt.Sprintf("host-%d.example.org.", j), dns.TypeA))
+					if resp.msg.Rcode != dns.RcodeSuccess && resp.msg.Rcode != dns.RcodeNameError {
+						t.Errorf("unexpected rcode %d", resp.msg.Rcode)
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("host-%d.example.org.", i)
+		router.Handle(name+" A 127.0.0.1", nil)
+
+		h := router.Lookup(name, dns.ClassINET).Search(dns.TypeA)
+		if _, ok := h.(RcodeHandler); ok {
+			t.Fatalf("%s: not found after Handle returned", name)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		resp := new(responseWriter)
+		router.ServeDNS(resp, NewRequest(fmt.Sprintf("host-%d.example.org.", i), dns.TypeA))
+		if len(resp.msg.Answer) != 1 {
+			t.Fatalf("host-%d: expected 1 answer, got %v", i, resp.msg.Answer)
+		}
+	}
+}
+
+func TestRouterSnapshot(t *testing.T) {
+	router := New()
+	router.Handle("a.example.org A 127.0.0.1", nil)
+
+	class := router.Lookup("b.example.org", dns.ClassINET)
+	router.Handle("b.example.org A 127.0.0.2", nil)
+
+	// a Class keeps looking at the trees it was found in
+	if _, ok := class.Search(dns.TypeA).(RcodeHandler); !ok {
+		t.Fatal("modified a published tree")
+	}
+	if _, ok := router.Lookup("b.example.org", dns.ClassINET).Search(dns.TypeA).(RcodeHandler); ok {
+		t.Fatal("missing new route")
+	}
+
+	recv := catchPanic(func() {
+		router.HandleZone(strings.NewReader("c.example.org. 3600 IN A 127.0.0.3\nd.example.org. 3600 IN A 127.0.0"), "example.org.", "stdin")
+	})
+	if recv == nil {
+		t.Fatal("expected a panic")
+	}
+	if _, ok := router.Lookup("c.example.org", dns.ClassINET).Search(dns.TypeA).(RcodeHandler); !ok {
+		t.Fatal("published a partial zone")
+	}
+}
+
+func TestRouterRemove(t *testing.T) {
+	const s = `
+$TTL    30M
+$ORIGIN example.org.
+@       IN      SOA     linode.atoom.net. miek.miek.nl. (
+                             1282630057 ; Serial
+                             4H         ; Refresh
+                             1H         ; Retry
+                             7D         ; Expire
+                             4H )       ; Negative Cache TTL
+        IN      NS      a.iana-servers.net.
+a       IN      A       127.0.0.1
+        IN      AAAA    ::1
+sub     IN      NS      ns.sub.example.org.
+ns.sub  IN      A       127.0.0.2`
+
+	router := New()
+	router.HandleZone(strings.NewReader(s), "example.org.", "stdin")
+	router.Handle("b.example.org A 127.0.0.3", nil)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		resp := new(responseWriter)
+		router.ServeDNS(resp, NewRequest(qname, qtype))
+		return &resp.msg
+	}
+
+	if router.Remove("c.example.org", dns.ClassINET, dns.TypeA) {
+		t.Fatal("removed an unregistered name")
+	}
+	if router.Remove("a.example.org", dns.ClassCHAOS, dns.TypeA) {
+		t.Fatal("removed from an unregistered class")
+	}
+
+	if !router.Remove("a.example.org", dns.ClassINET, dns.TypeA) {
+		t.Fatal("failed to remove a.example.org A")
+	}
+	if m := query("a.example.org.", dns.TypeA); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("expected NODATA, got %v", m)
+	}
+	if m := query("a.example.org.", dns.TypeAAAA); len(m.Answer) != 1 {
+		t.Fatalf("expected AAAA, got %v", m)
+	}
+
+	if m := query("www.sub.example.org.", dns.TypeA); m.Authoritative || !Exists(m.Ns, dns.TypeNS) {
+		t.Fatalf("expected a referral, got %v", m)
+	}
+	if !router.Remove("sub.example.org", dns.ClassINET, dns.TypeANY) {
+		t.Fatal("failed to remove sub.example.org")
+	}
+	if m := query("www.sub.example.org.", dns.TypeA); m.Rcode != dns.RcodeNameError || !Exists(m.Ns, dns.TypeSOA) {
+		t.Fatalf("expected NXDOMAIN, got %v", m)
+	}
+
+	if !router.RemoveZone("Example.ORG") {
+		t.Fatal("failed to remove zone")
+	}
+	if router.RemoveZone("example.org.") {
+		t.Fatal("removed zone twice")
+	}
+	for _, name := range []string{"example.org.", "a.example.org.", "ns.sub.example.org."} {
+		if m := query(name, dns.TypeA); m.Rcode != dns.RcodeRefused {
+			t.Fatalf("%s: expected REFUSED, got %v", name, m)
+		}
+	}
+
+	// records which don't belong to the zone are kept
+	if m := query("b.example.org.", dns.TypeA); len(m.Answer) != 1 {
+		t.Fatalf("expected A, got %v", m)
+	}
+}
+
+func TestRouterLoadZone(t *testing.T) {
+	const s = `
+$TTL    30M
+$ORIGIN example.org.
+@       IN      SOA     linode.atoom.net. miek.miek.nl. (
+                             1282630057 ; Serial
+                             4H         ; Refresh
+                             1H         ; Retry
+                             7D         ; Expire
+                             4H )       ; Negative Cache TTL
+a       IN      A       127.0.0.1
+:x      IN      A       127.0.0.2
+:y      IN      A       127.0.0.3
+:z      IN      A       127.0.0.4`
+
+	router := New()
+	router.Handle("b.example.org A 127.0.0.1", nil)
+
+	err := router.LoadZone(strings.NewReader(s), "example.org", "stdin")
+	zoneErr, ok := err.(*ZoneError)
+	if !ok {
+		t.Fatalf("expected *ZoneError, got %v", err)
+	}
+	if zoneErr.Origin != "example.org." || len(zoneErr.Errors) != 3 {
+		t.Fatalf("expected 3 errors of example.org., got %v", zoneErr)
+	}
+	for _, err := range zoneErr.Errors {
+		if !strings.HasPrefix(err.Error(), "stdin: ") || !strings.Contains(err.Error(), "conflicts with existing") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if !strings.Contains(err.Error(), "(and 2 more errors)") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// nothing changed
+	for _, name := range []string{"example.org", "a.example.org", "x.example.org"} {
+		if _, ok := router.Lookup(name, dns.ClassINET).Search(dns.TypeANY).(RcodeHandler); !ok {
+			t.Fatalf("%s: loaded from a rejected zone", name)
+		}
+	}
+
+	err = router.LoadZone(strings.NewReader("a.example.org. IN A 127.0.0.1\nb.example.org. IN A 127.0.0"), "example.org", "db.example")
+	zoneErr, ok = err.(*ZoneError)
+	if !ok || len(zoneErr.Errors) != 1 {
+		t.Fatalf("expected a parsing error, got %v", err)
+	}
+	if _, ok := zoneErr.Errors[0].(*dns.ParseError); !ok || !strings.Contains(err.Error(), "db.example") {
+		t.Fatalf("expected a parsing error, got %v", zoneErr.Errors[0])
+	}
+	if _, ok := router.Lookup("a.example.org", dns.ClassINET).Search(dns.TypeA).(RcodeHandler); !ok {
+		t.Fatal("loaded from a rejected zone")
+	}
+
+	if err := router.LoadZoneFile("example.org", "testdata/nonexistent"); err == nil {
+		t.Fatal("expected an error for a nonexistent file")
+	}
+
+	if err := router.LoadZone(strings.NewReader(s[:strings.Index(s, ":x")]), "example.org", "stdin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := router.Lookup("a.example.org", dns.ClassINET).Search(dns.TypeA).(RcodeHandler); ok {
+		t.Fatal("failed to load zone")
+	}
+}
+
 func BenchmarkRouterLookup(b *testing.B) {
 	const s = `
 $TTL    30M
@@ -293,6 +511,21 @@ mx		IN	MX      10 a.miek.nl.`
 	})
 }
 
+func BenchmarkRouterHandle(b *testing.B) {
+	router := New()
+	router.Handle("example.org. 3600 IN SOA ns1.example.org. hostmaster.example.org. 1 7200 3600 1209600 3600", nil)
+
+	names := make([]string, b.N)
+	for i := range names {
+		names[i] = fmt.Sprintf("host%d.example.org. 3600 IN A 127.0.0.1", i)
+	}
+
+	b.ResetTimer()
+	for _, s := range names {
+		router.Handle(s, nil)
+	}
+}
+
 func TestCNAME(t *testing.T) {
 	const s = `
 $TTL    30M
@@ -1423,6 +1656,39 @@ a.b.c.miek.nl.		1800	IN A	127.0.0.1
 	}
 }
 
+func TestLookupEntNoDnssec(t *testing.T) {
+	const s = `
+$TTL    30M
+$ORIGIN miek.nl.
+@       IN      SOA     linode.atoom.net. miek.miek.nl. 1282630057 14400 3600 604800 14400
+        IN      NS      linode.atoom.net.
+a       IN      A       127.0.0.1
+y.x.b   IN      A       127.0.0.1
+aa.aa.y.b IN    A       127.0.0.2`
+
+	soaRR := soa("miek.nl.	1800	IN	SOA	linode.atoom.net. miek.miek.nl. 1282630057 14400 3600 604800 14400")
+	var dnsTestCases = []testCase{
+		// empty non-terminals
+		{Qname: "b.miek.nl.", Qtype: dns.TypeA, Ns: []dns.RR{soaRR}},
+		{Qname: "x.b.miek.nl.", Qtype: dns.TypeA, Ns: []dns.RR{soaRR}},
+		{Qname: "aa.y.b.miek.nl.", Qtype: dns.TypeA, Ns: []dns.RR{soaRR}},
+		// sharing the tree node "b." but not existing
+		{Qname: "b.b.miek.nl.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError, Ns: []dns.RR{soaRR}},
+		{Qname: "a.x.b.miek.nl.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError, Ns: []dns.RR{soaRR}},
+		{Qname: "c.miek.nl.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError, Ns: []dns.RR{soaRR}},
+	}
+
+	router := New()
+	router.HandleZone(strings.NewReader(s), "miek.nl.", "stdin")
+
+	for _, tc := range dnsTestCases {
+		resp := new(responseWriter)
+		req := &Request{Msg: tc.Msg()}
+		router.ServeDNS(resp, req)
+		sortAndCheck(t, &resp.msg, tc)
+	}
+}
+
 func TestLookupDS(t *testing.T) {
 	const s = `
 $TTL    30M
@@ -2850,7 +3116,7 @@ alias.example.org.      IN      TXT     "Wildcard CNAME expansion"
 	router.HandleZone(strings.NewReader(miekZone), "miek.nl.", "stdin")
 	router.HandleZone(strings.NewReader(exampleZone), "example.org.", "stdin")
 
-	//printChildren(router.trees[dns.ClassINET], "")
+	//printChildren(router.loadTrees()[dns.ClassINET], "")
 
 	for _, tc := range dnsTestCases {
 		resp := new(responseWriter)
@@ -0,0 +1,234 @@
+package dnsrouter
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultSecondaryRetry is the default interval of retrying a secondary zone
+// which hasn't been transferred.
+const DefaultSecondaryRetry = time.Minute
+
+// MinSecondaryInterval is the minimum interval between refreshes of a started
+// Secondary, regardless of SOA timers.
+const MinSecondaryInterval = time.Second
+
+// A Secondary keeps a zone of the Router in sync with its primary name server
+// by zone transfers (https://tools.ietf.org/html/rfc1034#section-4.3.5).
+// The zone is loaded as HandleZone does, so that it is able to be served and
+// transferred to other secondaries as well.
+// Once started, the Secondary polls the SOA of the primary according to the
+// refresh and retry timers of the zone, pulls changes by IXFR, or AXFR if the
+// primary doesn't serve the incremental transfer, and removes the zone from the
+// Router if it cannot be refreshed within the expire timer.
+type Secondary struct {
+	// Router to load the zone into.
+	Router *Router
+
+	// Origin of the zone.
+	Origin string
+
+	// Primary is the address of the primary name server, e.g. "192.0.2.1:53".
+	Primary string
+
+	// Retry is the interval of retrying before the zone is transferred, after
+	// which the SOA timers are honored. If it is zero, then uses DefaultSecondaryRetry.
+	Retry time.Duration
+
+	// OnRefresh is called after each refresh by the started Secondary if it is
+	// not nil, with the result of Refresh.
+	OnRefresh func(diff *ZoneDiff, err error)
+
+	mu     sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+	notify chan struct{}
+}
+
+// NewSecondary returns a Secondary of the zone with the primary.
+func NewSecondary(r *Router, origin, primary string) *Secondary {
+	return &Secondary{Router: r, Origin: origin, Primary: primary}
+}
+
+// Refresh checks the SOA of the primary, and transfers the zone if it has a
+// greater serial. A nil ZoneDiff is returned if the zone is up to date.
+func (s *Secondary) Refresh() (*ZoneDiff, error) {
+	origin := dns.Fqdn(s.Origin)
+	soa := s.Router.zoneSOA(origin, dns.ClassINET)
+
+	m := new(dns.Msg)
+	m.SetQuestion(origin, dns.TypeSOA)
+	resp, _, err := new(dns.Client).Exchange(m, s.Primary)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp"}).Exchange(m, s.Primary)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s: SOA query failed: %s", s.Primary, dns.RcodeToString[resp.Rcode])
+	}
+	primarySOA := findSOA(resp.Answer, origin)
+	if primarySOA == nil {
+		return nil, fmt.Errorf("%s: no SOA for %s", s.Primary, origin)
+	}
+
+	if soa != nil {
+		if !serialGreater(primarySOA.Serial, soa.Serial) {
+			return nil, nil
+		}
+
+		m := new(dns.Msg)
+		m.SetIxfr(origin, soa.Serial, soa.Ns, soa.Mbox)
+		rrs, err := s.transfer(m)
+		if err != nil {
+			return nil, err
+		}
+
+		latest, ok := rrs[0].(*dns.SOA)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%s: no SOA leading IXFR of %s", s.Primary, origin)
+		case len(rrs) == 1 || !serialGreater(latest.Serial, soa.Serial):
+			// up to date
+			return nil, nil
+		case len(rrs) == 2 || rrs[1].Header().Rrtype != dns.TypeSOA:
+			// a full zone in AXFR format, which is the SOA only if two records
+			return s.Router.reloadRecords(rrs[:len(rrs)-1], origin, s.Primary)
+		}
+		if diff, err := s.Router.patchZone(rrs[1:len(rrs)-1], origin, dns.ClassINET, s.Primary); err == nil {
+			return diff, nil
+		}
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr(origin)
+	rrs, err := s.transfer(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(rrs) < 2 {
+		return nil, errIncompleteTransfer
+	}
+	return s.Router.reloadRecords(rrs[:len(rrs)-1], origin, s.Primary)
+}
+
+var (
+	errEmptyTransfer      = errors.New("dnsrouter: empty zone transfer")
+	errIncompleteTransfer = errors.New("dnsrouter: incomplete zone transfer")
+)
+
+func (s *Secondary) transfer(m *dns.Msg) ([]dns.RR, error) {
+	env, err := new(dns.Transfer).In(m, s.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			err = e.Error
+			continue
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if err == nil && len(rrs) == 0 {
+		err = errEmptyTransfer
+	}
+	return rrs, err
+}
+
+// Start refreshes the zone immediately and then according to the SOA timers,
+// but no more often than MinSecondaryInterval, or on being notified, in a new
+// goroutine, until Stop is called.
+func (s *Secondary) Start() {
+	s.mu.Lock()
+	if s.stop != nil {
+		s.mu.Unlock()
+		panic("secondary already started")
+	}
+	stop, done, notify := make(chan struct{}), make(chan struct{}), make(chan struct{}, 1)
+	s.stop, s.done, s.notify = stop, done, notify
+	s.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		s.run(stop, notify)
+	}()
+}
+
+// Notify makes the started Secondary refresh the zone immediately, e.g. on
+// receiving a NOTIFY from the primary. It has no effect if not started.
+func (s *Secondary) Notify() {
+	s.mu.Lock()
+	notify := s.notify
+	s.mu.Unlock()
+
+	if notify != nil {
+		select {
+		case notify <- struct{}{}:
+		default:
+			// a refresh is pending
+		}
+	}
+}
+
+// Stop stops refreshing and waits for the refreshing goroutine to exit.
+func (s *Secondary) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done, s.notify = nil, nil, nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *Secondary) run(stop, notify <-chan struct{}) {
+	var expireAt time.Time
+	for {
+		diff, err := s.Refresh()
+		if s.OnRefresh != nil {
+			s.OnRefresh(diff, err)
+		}
+
+		wait := s.Retry
+		if wait <= 0 {
+			wait = DefaultSecondaryRetry
+		}
+
+		now := time.Now()
+		if soa := s.Router.zoneSOA(s.Origin, dns.ClassINET); soa != nil {
+			if err == nil || expireAt.IsZero() {
+				expireAt = now.Add(time.Duration(soa.Expire) * time.Second)
+			}
+			if err == nil {
+				wait = time.Duration(soa.Refresh) * time.Second
+			} else if now.Before(expireAt) {
+				wait = time.Duration(soa.Retry) * time.Second
+			} else {
+				s.Router.RemoveZone(s.Origin)
+				expireAt = time.Time{}
+			}
+		}
+		if wait < MinSecondaryInterval {
+			wait = MinSecondaryInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-notify:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
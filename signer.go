@@ -0,0 +1,246 @@
+package dnsrouter
+
+import (
+	"crypto"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultSignatureValidity is the default validity period of signatures.
+	DefaultSignatureValidity = 7 * 24 * time.Hour
+
+	// DefaultSignatureCache is the default maximum number of cached signatures.
+	DefaultSignatureCache = 10000
+)
+
+// SigningKey is a DNSKEY with its private key.
+type SigningKey struct {
+	DNSKEY     *dns.DNSKEY
+	PrivateKey crypto.Signer
+}
+
+// Signer signs responses on the fly (https://tools.ietf.org/html/rfc4035#section-3)
+// with keys of zones. The middleware should be chained with a Router, and be
+// placed before WildcardHandler and other middlewares filling out records, so
+// that wildcard answers are signed as expanded, i.e. owned by the query name,
+// which requires no wildcard proof, e.g.
+//
+//	router.Middleware = []Middleware{
+//		PanicHandler,
+//		RefusedHandler,
+//		OptHandler,
+//		signer.Handler,
+//		WildcardHandler,
+//		NsecHandler, // or CompactNsecHandler
+//		NsHandler,
+//		ExtraHandler,
+//		CnameHandler,
+//		BasicHandler,
+//	}
+//
+// DNSKEY records are not generated, which should be served by zones.
+type Signer struct {
+	// Validity is the validity period of signatures, if it is zero then
+	// defaults to DefaultSignatureValidity. A signature is reused from cache
+	// for a quarter of the period.
+	Validity time.Duration
+
+	// MaxCache is the maximum number of cached signatures, if it is zero then
+	// defaults to DefaultSignatureCache, a negative value disables caching.
+	MaxCache int
+
+	mu     sync.RWMutex
+	keys   map[string][]SigningKey
+	window int64
+	cache  map[signatureKey]*dns.RRSIG
+}
+
+type signatureKey struct {
+	rrset  string
+	keyTag uint16
+}
+
+// AddKey adds a key to sign records of the zone.
+// A key with SEP flag signs DNSKEY records only, unless the zone has no other keys,
+// and vice versa.
+func (s *Signer) AddKey(origin string, key *dns.DNSKEY, privateKey crypto.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil {
+		s.keys = make(map[string][]SigningKey)
+	}
+	origin = strings.ToLower(dns.Fqdn(origin))
+	s.keys[origin] = append(s.keys[origin], SigningKey{DNSKEY: key, PrivateKey: privateKey})
+}
+
+// Handler is a middleware signing RRsets of ANSWER and AUTHORITY sections
+// which are not signed yet, if the request is DNSSEC OK. Delegations are not signed.
+func (s *Signer) Handler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		h.ServeDNS(w, req)
+
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			return
+		}
+
+		result := w.Msg()
+		result.Answer = s.sign(result.Answer)
+		result.Ns = s.sign(result.Ns)
+	})
+}
+
+// sign appends signatures of unsigned RRsets.
+func (s *Signer) sign(rrs []dns.RR) []dns.RR {
+	type rrsetKey struct {
+		name  string
+		qtype uint16
+	}
+
+	var (
+		keys   []rrsetKey
+		rrsets = make(map[rrsetKey][]dns.RR)
+		signed = make(map[rrsetKey]bool)
+	)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+		case dns.TypeRRSIG:
+			signed[rrsetKey{strings.ToLower(hdr.Name), rr.(*dns.RRSIG).TypeCovered}] = true
+		default:
+			k := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+			if rrsets[k] == nil {
+				keys = append(keys, k)
+			}
+			rrsets[k] = append(rrsets[k], rr)
+		}
+	}
+
+	for _, k := range keys {
+		if signed[k] {
+			continue
+		}
+
+		name := k.name
+		if k.qtype == dns.TypeDS {
+			// signed by the parent zone
+			off, end := dns.NextLabel(name, 0)
+			if end {
+				continue
+			}
+			name = name[off:]
+		}
+
+		origin, zoneKeys := s.zoneKeys(name)
+		if zoneKeys == nil || k.qtype == dns.TypeNS && k.name != origin {
+			continue
+		}
+
+		for _, key := range selectKeys(zoneKeys, k.qtype == dns.TypeDNSKEY) {
+			if sig := s.signature(rrsets[k], origin, key); sig != nil {
+				rrs = append(rrs, sig)
+			}
+		}
+	}
+	return rrs
+}
+
+// zoneKeys returns keys of the nearest zone enclosing the name.
+func (s *Signer) zoneKeys(name string) (string, []SigningKey) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if keys := s.keys[name[off:]]; keys != nil {
+			return name[off:], keys
+		}
+	}
+	return "", nil
+}
+
+// selectKeys returns keys with SEP flag if sep is set, or keys without SEP
+// flag otherwise. All keys are returned if no such keys.
+func selectKeys(keys []SigningKey, sep bool) []SigningKey {
+	var l []SigningKey
+	for _, key := range keys {
+		if (key.DNSKEY.Flags&dns.SEP != 0) == sep {
+			l = append(l, key)
+		}
+	}
+	if l == nil {
+		return keys
+	}
+	return l
+}
+
+// signature returns a signature of the RRset from cache, or signs a new one.
+func (s *Signer) signature(rrset []dns.RR, origin string, key SigningKey) *dns.RRSIG {
+	validity := s.Validity
+	if validity <= 0 {
+		validity = DefaultSignatureValidity
+	}
+	start := time.Now().Truncate(validity / 4)
+
+	var ck signatureKey
+	if s.MaxCache >= 0 {
+		l := make([]string, len(rrset))
+		for i, rr := range rrset {
+			l[i] = rr.String()
+		}
+		sort.Strings(l)
+		ck = signatureKey{strings.Join(l, "\n"), key.DNSKEY.KeyTag()}
+
+		s.mu.RLock()
+		sig := s.cache[ck]
+		window := s.window
+		s.mu.RUnlock()
+		if sig != nil && window == start.Unix() {
+			return sig
+		}
+	}
+
+	// allows clock skew of validators
+	sig, err := signRRset(rrset, origin, key, start.Add(-time.Hour), start.Add(validity))
+	if err != nil {
+		log.Println("dns.RRSIG.Sign error:", err)
+		return nil
+	}
+
+	if s.MaxCache >= 0 {
+		max := s.MaxCache
+		if max == 0 {
+			max = DefaultSignatureCache
+		}
+
+		s.mu.Lock()
+		if s.window != start.Unix() || len(s.cache) >= max {
+			s.window = start.Unix()
+			s.cache = make(map[signatureKey]*dns.RRSIG)
+		}
+		s.cache[ck] = sig
+		s.mu.Unlock()
+	}
+	return sig
+}
+
+// signRRset signs the RRset with the key of the zone.
+func signRRset(rrset []dns.RR, origin string, key SigningKey, inception, expiration time.Time) (*dns.RRSIG, error) {
+	sig := new(dns.RRSIG)
+	sig.Hdr.Ttl = rrset[0].Header().Ttl
+	sig.Algorithm = key.DNSKEY.Algorithm
+	sig.KeyTag = key.DNSKEY.KeyTag()
+	sig.SignerName = origin
+	sig.Inception = uint32(inception.Unix())
+	sig.Expiration = uint32(expiration.Unix())
+	if err := sig.Sign(key.PrivateKey, rrset); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
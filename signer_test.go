@@ -0,0 +1,267 @@
+package dnsrouter
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestKey(t *testing.T, origin string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: origin, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, privateKey.(crypto.Signer)
+}
+
+func TestSigner(t *testing.T) {
+	ksk, kskPrivate := newTestKey(t, "example.org.", dns.ZONE|dns.SEP)
+	zsk, zskPrivate := newTestKey(t, "example.org.", dns.ZONE)
+
+	signer := new(Signer)
+	signer.AddKey("Example.Org", ksk, kskPrivate)
+	signer.AddKey("example.org.", zsk, zskPrivate)
+
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		ksk.String(),
+		zsk.String(),
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 127.0.0.1",
+		"a 3600 IN A 127.0.0.2",
+		"www 3600 IN CNAME a",
+		"*.w 3600 IN A 127.0.0.3",
+		"sub 3600 IN NS ns.sub",
+		"ns.sub 3600 IN A 127.0.0.4",
+	)), "example.org.", "stdin")
+	router.Middleware = []Middleware{
+		PanicHandler,
+		RefusedHandler,
+		OptHandler,
+		signer.Handler,
+		WildcardHandler,
+		NsecHandler,
+		NsHandler,
+		ExtraHandler,
+		CnameHandler,
+		BasicHandler,
+	}
+
+	query := func(qname string, qtype uint16, do bool) *dns.Msg {
+		req := NewRequest(qname, qtype)
+		if do {
+			req.SetEdns0(4096, true)
+		}
+		w := NewResponseWriter()
+		router.ServeDNS(w, req)
+		return w.Msg()
+	}
+
+	// verify checks that all RRsets are signed by expected keys, except unsigned ones.
+	verify := func(rrs []dns.RR, unsigned ...uint16) {
+		rrsets := make(map[uint16][]dns.RR)
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeRRSIG {
+				rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+			}
+		}
+		for _, qtype := range unsigned {
+			delete(rrsets, qtype)
+		}
+
+		for _, rr := range rrs {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok {
+				continue
+			}
+			rrset := rrsets[sig.TypeCovered]
+			if rrset == nil {
+				t.Errorf("unexpected signature: %v", sig)
+				continue
+			}
+			key := zsk
+			if sig.TypeCovered == dns.TypeDNSKEY {
+				key = ksk
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				t.Errorf("failed to verify %v: %v", sig, err)
+			}
+			if !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("invalid validity period: %v", sig)
+			}
+			delete(rrsets, sig.TypeCovered)
+		}
+		for qtype := range rrsets {
+			t.Errorf("missing signature of %s", dns.TypeToString[qtype])
+		}
+	}
+
+	m := query("a.example.org.", dns.TypeA, true)
+	if len(m.Answer) != 2 {
+		t.Fatalf("unexpected answer: %v", m.Answer)
+	}
+	verify(m.Answer)
+	verify(m.Ns)
+
+	// signatures are cached
+	if n := query("a.example.org.", dns.TypeA, true); n.Answer[1].(*dns.RRSIG).Signature != m.Answer[1].(*dns.RRSIG).Signature {
+		t.Error("signature is not cached")
+	}
+
+	// no signatures without DO
+	if m := query("a.example.org.", dns.TypeA, false); len(m.Answer) != 1 {
+		t.Errorf("unexpected answer: %v", m.Answer)
+	}
+
+	// DNSKEY is signed by KSK
+	m = query("example.org.", dns.TypeDNSKEY, true)
+	if len(m.Answer) != 3 {
+		t.Fatalf("unexpected answer: %v", m.Answer)
+	}
+	verify(m.Answer)
+
+	// CNAME chasing
+	m = query("www.example.org.", dns.TypeA, true)
+	if len(m.Answer) != 4 {
+		t.Fatalf("unexpected answer: %v", m.Answer)
+	}
+	verify(m.Answer)
+
+	// wildcard is signed as expanded
+	m = query("x.w.example.org.", dns.TypeA, true)
+	if len(m.Answer) != 2 || m.Answer[0].Header().Name != "x.w.example.org." ||
+		m.Answer[1].Header().Name != "x.w.example.org." || m.Answer[1].(*dns.RRSIG).Labels != 4 {
+		t.Fatalf("unexpected answer: %v", m.Answer)
+	}
+	verify(m.Answer)
+
+	// no data
+	m = query("a.example.org.", dns.TypeAAAA, true)
+	if len(m.Answer) != 0 || !Exists(m.Ns, dns.TypeSOA) {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	verify(m.Ns)
+
+	// delegation is not signed
+	m = query("www.sub.example.org.", dns.TypeA, true)
+	if len(m.Answer) != 0 || !Exists(m.Ns, dns.TypeNS) {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	verify(m.Ns, dns.TypeNS)
+	if Exists(m.Ns, dns.TypeRRSIG) {
+		t.Errorf("unexpected signature: %v", m.Ns)
+	}
+}
+
+func TestCompactNsecHandler(t *testing.T) {
+	zsk, zskPrivate := newTestKey(t, "example.org.", dns.ZONE)
+
+	signer := new(Signer)
+	signer.AddKey("example.org.", zsk, zskPrivate)
+
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		zsk.String(),
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 127.0.0.1",
+		"a 3600 IN A 127.0.0.2",
+		"a 3600 IN TXT hello",
+		"*.w 3600 IN A 127.0.0.3",
+		"sub 3600 IN NS ns.sub",
+		"ns.sub 3600 IN A 127.0.0.4",
+	)), "example.org.", "stdin")
+	router.Middleware = []Middleware{
+		PanicHandler,
+		RefusedHandler,
+		OptHandler,
+		signer.Handler,
+		WildcardHandler,
+		CompactNsecHandler,
+		NsHandler,
+		ExtraHandler,
+		CnameHandler,
+		BasicHandler,
+	}
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		req := NewRequest(qname, qtype)
+		req.SetEdns0(4096, true)
+		w := NewResponseWriter()
+		router.ServeDNS(w, req)
+		return w.Msg()
+	}
+
+	// verify checks the NSEC in AUTHORITY section and its signature.
+	verify := func(m *dns.Msg, owner string, types ...uint16) {
+		i := First(m.Ns, dns.TypeNSEC)
+		if i == -1 {
+			t.Errorf("missing NSEC: %v", m)
+			return
+		}
+		nsec := m.Ns[i].(*dns.NSEC)
+		if nsec.Hdr.Name != owner || nsec.NextDomain != `\000.`+owner {
+			t.Errorf("unexpected NSEC: %v", nsec)
+		}
+		types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+		if fmt.Sprint(nsec.TypeBitMap) != fmt.Sprint(types) {
+			t.Errorf("expected types %v, got %v", types, nsec.TypeBitMap)
+		}
+
+		for _, rr := range m.Ns {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeNSEC {
+				if err := sig.Verify(zsk, []dns.RR{nsec}); err != nil {
+					t.Errorf("failed to verify %v: %v", sig, err)
+				}
+				return
+			}
+		}
+		t.Errorf("missing signature of NSEC: %v", m.Ns)
+	}
+
+	// nonexistent name
+	m := query("b.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || !Exists(m.Ns, dns.TypeSOA) {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	verify(m, "b.example.org.")
+
+	// no data
+	m = query("a.example.org.", dns.TypeAAAA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	verify(m, "a.example.org.", dns.TypeA, dns.TypeTXT)
+
+	// empty non-terminal
+	m = query("w.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	verify(m, "w.example.org.")
+
+	// wildcard is signed as expanded, without NSEC
+	m = query("x.w.example.org.", dns.TypeA)
+	if len(m.Answer) != 2 || m.Answer[1].(*dns.RRSIG).Labels != 4 || Exists(m.Ns, dns.TypeNSEC) {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	if err := m.Answer[1].(*dns.RRSIG).Verify(zsk, m.Answer[:1]); err != nil {
+		t.Errorf("failed to verify %v: %v", m.Answer[1], err)
+	}
+
+	// unsigned delegation
+	m = query("www.sub.example.org.", dns.TypeA)
+	if len(m.Answer) != 0 || !Exists(m.Ns, dns.TypeNS) {
+		t.Fatalf("unexpected response: %v", m)
+	}
+	verify(m, "sub.example.org.", dns.TypeNS)
+}
@@ -0,0 +1,195 @@
+package dnsrouter
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTransferRecords is the default number of records in a message of zone transfer.
+const DefaultTransferRecords = 100
+
+// maxTsigMACSize is the size of HMAC-SHA512, the longest MAC of TSIG algorithms.
+const maxTsigMACSize = 64
+
+// zoneStub is a Stub capable of zone transfer, which is implemented by Router.
+type zoneStub interface {
+	zone(name string, qclass uint16) []dns.RR
+	zoneSOA(name string, qclass uint16) *dns.SOA
+	ixfr(name string, qclass uint16, serial uint32) ([]dns.RR, bool)
+}
+
+// Transfer serves outgoing zone transfers, both AXFR (https://tools.ietf.org/html/rfc5936)
+// and IXFR (https://tools.ietf.org/html/rfc1995).
+// The middleware should be chained with a Router, and be placed before any
+// other middleware writing answers, e.g.
+//
+//	router.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+type Transfer struct {
+	// ACL and Keys match clients allowed to transfer, see ACL.
+	ACL  ACL
+	Keys []string
+
+	// MaxRecords is the maximum number of records in a message, if it is zero
+	// then defaults to DefaultTransferRecords. A message is also limited by the
+	// maximum message size.
+	MaxRecords int
+}
+
+// Handler is a middleware serving AXFR and IXFR requests, other requests are passed to h.
+// A zone is transferred in canonical order and enveloped by its SOA, across
+// multiple messages over the connection of Classic, so that a transfer is only
+// available if the handler is served by Classic over TCP.
+// An IXFR is served from the journal of the Router, it falls back to AXFR if
+// the journal doesn't cover the serial of client. Over UDP, an IXFR which
+// doesn't fit into a single message is responded with the current SOA only,
+// to inform the client to retry over TCP, as well as one exceeding Sizer.MaxLen.
+func (t *Transfer) Handler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		switch req.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			t.serve(w, req)
+		default:
+			h.ServeDNS(w, req)
+		}
+	})
+}
+
+func (t *Transfer) serve(w ResponseWriter, req *Request) {
+	result := w.Msg()
+	qtype := req.Question[0].Qtype
+
+	// transfers are streamed through the underlying connection
+	addr := remoteAddr(w)
+	if _, ok := w.(Hijacker); addr == nil || !ok {
+		result.Rcode = dns.RcodeRefused
+		return
+	}
+
+	udp := connNetwork(w) == "udp"
+	if udp && qtype == dns.TypeAXFR {
+		// AXFR is only defined over TCP
+		result.Rcode = dns.RcodeNotImplemented
+		return
+	}
+	if !t.ACL.ContainsAddr(addr) && !tsigAllowed(req, t.Keys) {
+		result.Rcode = dns.RcodeRefused
+		return
+	}
+
+	var stub zoneStub
+	if classValue := req.Context().Value(ClassContextKey); classValue != nil {
+		stub, _ = classValue.(Class).Stub().(zoneStub)
+	}
+	if stub == nil {
+		result.Rcode = dns.RcodeRefused
+		return
+	}
+
+	qname, qclass := req.Question[0].Name, req.Question[0].Qclass
+	soa := stub.zoneSOA(qname, qclass)
+	if soa == nil {
+		result.Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	var rrs []dns.RR
+	if qtype == dns.TypeIXFR {
+		var serial uint32
+		if i := First(req.Ns, dns.TypeSOA); i != -1 {
+			serial = req.Ns[i].(*dns.SOA).Serial
+		} else {
+			result.Rcode = dns.RcodeFormatError
+			return
+		}
+
+		if !serialGreater(soa.Serial, serial) {
+			// up to date
+			rrs = []dns.RR{soa}
+		} else if changes, ok := stub.ixfr(qname, qclass, serial); ok {
+			rrs = append([]dns.RR{soa}, changes...)
+			rrs = append(rrs, soa)
+		}
+	}
+	if rrs == nil {
+		rrs = stub.zone(qname, qclass)
+		if rrs == nil {
+			// removed in the meantime
+			result.Rcode = dns.RcodeNotAuth
+			return
+		}
+		rrs = append(rrs, rrs[0])
+	}
+
+	size := dns.MaxMsgSize
+	if udp {
+		size = maxLen(w)
+	}
+	// room for records besides the header, the question and the TSIG
+	room := size - t.reply(req).Len() - maxTsigMACSize
+
+	envelopes := t.envelopes(rrs, room)
+	if udp && (len(envelopes) > 1 || recordsLen(envelopes[0]) > room) {
+		envelopes = [][]dns.RR{{soa}}
+	}
+
+	conn := hijack(w)
+	for i, answer := range envelopes {
+		m := t.reply(req)
+		m.Answer = copyRecords(answer)
+		if i == 1 && tsigKeyName(req) != "" {
+			// only timers are covered after the first message
+			conn.TsigTimersOnly(true)
+		}
+		if err := conn.WriteMsg(m); err != nil {
+			log.Println("dns.WriteMsg error:", err)
+			return
+		}
+	}
+}
+
+// reply returns a message without records in response to the request, which
+// is signed while written if the request is authenticated by Tsig.
+func (t *Transfer) reply(req *Request) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req.Msg)
+	m.Authoritative = true
+	if tsigKeyName(req) != "" {
+		m.Extra = append(m.Extra, newTsig(req.IsTsig(), 0))
+	}
+	return m
+}
+
+// envelopes splits records into messages, each of which has no more than
+// MaxRecords records, and records of no more than size bytes unless a single
+// record exceeds.
+func (t *Transfer) envelopes(rrs []dns.RR, size int) [][]dns.RR {
+	n := t.MaxRecords
+	if n <= 0 {
+		n = DefaultTransferRecords
+	}
+
+	var (
+		l     [][]dns.RR
+		start int
+		total int
+	)
+	for i, rr := range rrs {
+		rrLen := dns.Len(rr)
+		if i > start && (i-start == n || total+rrLen > size) {
+			l = append(l, rrs[start:i:i])
+			start, total = i, 0
+		}
+		total += rrLen
+	}
+	return append(l, rrs[start:])
+}
+
+// recordsLen returns the size of records in wire format without compression.
+func recordsLen(rrs []dns.RR) int {
+	var n int
+	for _, rr := range rrs {
+		n += dns.Len(rr)
+	}
+	return n
+}
@@ -0,0 +1,702 @@
+package dnsrouter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testConn is a dns.ResponseWriter recording written messages.
+type testConn struct {
+	remoteAddr net.Addr
+	msgs       []*dns.Msg
+}
+
+func (c *testConn) LocalAddr() net.Addr         { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (c *testConn) RemoteAddr() net.Addr        { return c.remoteAddr }
+func (c *testConn) WriteMsg(m *dns.Msg) error   { c.msgs = append(c.msgs, m); return nil }
+func (c *testConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *testConn) Close() error                { return nil }
+func (c *testConn) TsigStatus() error           { return nil }
+func (c *testConn) TsigTimersOnly(bool)         {}
+func (c *testConn) Hijack()                     {}
+func (c *testConn) Network() string             { return c.remoteAddr.Network() }
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL("192.0.2.0/24", "2001:db8::1", "198.51.100.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.100")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("198.51.100.7")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("198.51.100.8")}, false},
+		{&net.IPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{&net.IPAddr{IP: net.ParseIP("2001:db8::2")}, false},
+		{(*net.TCPAddr)(nil), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := acl.ContainsAddr(test.addr); got != test.want {
+			t.Errorf("%v: expected %v, got %v", test.addr, test.want, got)
+		}
+	}
+
+	for _, s := range []string{"192.0.2.0/33", "example.org"} {
+		if _, err := ParseACL(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestTransferAXFR(t *testing.T) {
+	const zone = `$ORIGIN example.org.
+@ 3600 IN SOA ns.example.org. admin.example.org. 1 7200 3600 604800 3600
+@ 3600 IN NS ns
+ns 3600 IN A 127.0.0.1
+z 3600 IN A 127.0.0.2
+a-b 3600 IN A 127.0.0.3
+x.a 3600 IN A 127.0.0.4
+* 3600 IN TXT "wildcard"
+:user.users 3600 IN TXT "param"
+sub 3600 IN NS ns.sub
+ns.sub 3600 IN A 127.0.0.5
+child 3600 IN NS ns.child
+`
+	const childZone = `$ORIGIN child.example.org.
+@ 3600 IN SOA ns.child.example.org. admin.example.org. 1 7200 3600 604800 3600
+@ 3600 IN NS ns
+ns 3600 IN A 127.0.0.6
+`
+
+	router := New()
+	router.HandleZone(strings.NewReader(zone), "example.org.", "stdin")
+	router.HandleZone(strings.NewReader(childZone), "child.example.org.", "stdin")
+	router.Handle("www.example.org. 3600 IN A 127.0.0.7", nil)
+	router.Handle("www.child.example.org. 3600 IN A 127.0.0.8", nil)
+	router.HandleFunc("dynamic.example.org. 3600 IN A", func(w ResponseWriter, req *Request) {})
+
+	transfer := &Transfer{MaxRecords: 4}
+	transfer.ACL, _ = ParseACL("127.0.0.0/8")
+	router.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+	handler := Classic(context.Background(), router)
+
+	axfr := func(qname string, addr net.Addr) *testConn {
+		conn := &testConn{remoteAddr: addr}
+		req := new(dns.Msg)
+		req.SetAxfr(qname)
+		handler.ServeDNS(conn, req)
+		return conn
+	}
+
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5353}
+	conn := axfr("example.org.", tcpAddr)
+
+	var names []string
+	for i, m := range conn.msgs {
+		if m.Rcode != dns.RcodeSuccess || !m.Authoritative || !m.Response {
+			t.Fatalf("unexpected message: %v", m)
+		}
+		if i < len(conn.msgs)-1 && len(m.Answer) != 4 {
+			t.Fatalf("expected 4 records in message %d, got %d", i, len(m.Answer))
+		}
+		for _, rr := range m.Answer {
+			names = append(names, dns.TypeToString[rr.Header().Rrtype]+" "+rr.Header().Name)
+		}
+	}
+
+	expected := []string{
+		"SOA example.org.",
+		"NS example.org.",
+		"TXT *.example.org.",
+		"A x.a.example.org.",
+		"A a-b.example.org.",
+		"NS child.example.org.",
+		"A ns.example.org.",
+		"NS sub.example.org.",
+		"A ns.sub.example.org.",
+		"A www.example.org.",
+		"A z.example.org.",
+		"SOA example.org.",
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected transfer:\n%s", strings.Join(names, "\n"))
+	}
+
+	conn = axfr("child.example.org.", tcpAddr)
+	names = nil
+	for _, m := range conn.msgs {
+		for _, rr := range m.Answer {
+			names = append(names, dns.TypeToString[rr.Header().Rrtype]+" "+rr.Header().Name)
+		}
+	}
+	expected = []string{
+		"SOA child.example.org.",
+		"NS child.example.org.",
+		"A ns.child.example.org.",
+		"A www.child.example.org.",
+		"SOA child.example.org.",
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected transfer:\n%s", strings.Join(names, "\n"))
+	}
+
+	tests := []struct {
+		qname string
+		addr  net.Addr
+		rcode int
+	}{
+		{"example.org.", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, dns.RcodeRefused},
+		{"example.org.", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5353}, dns.RcodeNotImplemented},
+		{"www.example.org.", tcpAddr, dns.RcodeNotAuth},
+		{"example.com.", tcpAddr, dns.RcodeNotAuth},
+	}
+	for _, test := range tests {
+		conn := axfr(test.qname, test.addr)
+		if len(conn.msgs) != 1 || conn.msgs[0].Rcode != test.rcode || len(conn.msgs[0].Answer) != 0 {
+			t.Errorf("%s from %v: expected rcode %d, got %v", test.qname, test.addr, test.rcode, conn.msgs)
+		}
+	}
+
+	// other requests are passed through
+	conn = &testConn{remoteAddr: tcpAddr}
+	handler.ServeDNS(conn, new(dns.Msg).SetQuestion("www.example.org.", dns.TypeA))
+	if len(conn.msgs) != 1 || len(conn.msgs[0].Answer) != 1 {
+		t.Fatalf("unexpected response: %v", conn.msgs)
+	}
+}
+
+func TestTransferIXFR(t *testing.T) {
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"a 3600 IN A 127.0.0.1", "b 3600 IN A 127.0.0.2")), "example.org.", "stdin")
+
+	transfer := &Transfer{MaxRecords: 4}
+	transfer.ACL, _ = ParseACL("127.0.0.1")
+	router.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+	handler := Classic(context.Background(), router)
+
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	ixfr := func(serial uint32, addr net.Addr) []string {
+		conn := &testConn{remoteAddr: addr}
+		req := new(dns.Msg)
+		req.SetIxfr("example.org.", serial, "ns.example.org.", "admin.example.org.")
+		handler.ServeDNS(conn, req)
+
+		var l []string
+		for _, m := range conn.msgs {
+			if m.Rcode != dns.RcodeSuccess {
+				t.Fatalf("unexpected message: %v", m)
+			}
+			for _, rr := range m.Answer {
+				if soa, ok := rr.(*dns.SOA); ok {
+					l = append(l, fmt.Sprintf("SOA %d", soa.Serial))
+				} else {
+					l = append(l, fmt.Sprintf("%s %d %s", rr.Header().Name, rr.Header().Ttl, dns.TypeToString[rr.Header().Rrtype]))
+				}
+			}
+		}
+		return l
+	}
+	expect := func(serial uint32, addr net.Addr, expected ...string) {
+		if got := ixfr(serial, addr); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("IXFR %d: unexpected transfer:\n%s", serial, strings.Join(got, "\n"))
+		}
+	}
+	reload := func(serial uint32, records ...string) {
+		if _, err := router.ReloadZone(strings.NewReader(newTestZone("example.org.", serial, records...)), "example.org.", "stdin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect(1, tcpAddr, "SOA 1")
+	expect(2, tcpAddr, "SOA 1")
+
+	reload(2, "b 3600 IN A 127.0.0.2", "c 3600 IN A 127.0.0.3")
+	reload(3, "b 60 IN A 127.0.0.2", "c 3600 IN A 127.0.0.3")
+
+	expect(1, tcpAddr,
+		"SOA 3",
+		"SOA 1", "a.example.org. 3600 A",
+		"SOA 2", "c.example.org. 3600 A",
+		"SOA 2", "b.example.org. 3600 A",
+		"SOA 3", "b.example.org. 60 A",
+		"SOA 3")
+	expect(2, tcpAddr,
+		"SOA 3",
+		"SOA 2", "b.example.org. 3600 A",
+		"SOA 3", "b.example.org. 60 A",
+		"SOA 3")
+
+	// falls back to AXFR
+	expect(0, tcpAddr, "SOA 3", "b.example.org. 60 A", "c.example.org. 3600 A", "SOA 3")
+
+	// too large for UDP
+	transfer.MaxRecords = 6
+	expect(1, udpAddr, "SOA 3")
+	expect(2, udpAddr, "SOA 3", "SOA 2", "b.example.org. 3600 A", "SOA 3", "b.example.org. 60 A", "SOA 3")
+	transfer.MaxRecords = 4
+
+	// changes without a new serial reset the journal
+	router.Handle("d.example.org. 3600 IN A 127.0.0.4", nil)
+	expect(2, tcpAddr, "SOA 3", "b.example.org. 60 A", "c.example.org. 3600 A", "d.example.org. 3600 A", "SOA 3")
+	router.Remove("d.example.org.", dns.ClassINET, dns.TypeA)
+	expect(2, tcpAddr, "SOA 3", "b.example.org. 60 A", "c.example.org. 3600 A", "SOA 3")
+
+	// so does the next change, which starts from an unidentified version
+	reload(4, "c 3600 IN A 127.0.0.3")
+	expect(3, tcpAddr, "SOA 4", "c.example.org. 3600 A", "SOA 4")
+
+	reload(5, "c 3600 IN A 127.0.0.3", "d 3600 IN A 127.0.0.4")
+	expect(4, tcpAddr, "SOA 5", "SOA 4", "SOA 5", "d.example.org. 3600 A", "SOA 5")
+
+	router.MaxJournal = 1
+	reload(6, "d 3600 IN A 127.0.0.4")
+	expect(5, tcpAddr, "SOA 6", "SOA 5", "c.example.org. 3600 A", "SOA 6", "SOA 6")
+	expect(4, tcpAddr, "SOA 6", "d.example.org. 3600 A", "SOA 6")
+
+	// no SOA in authority section
+	conn := &testConn{remoteAddr: tcpAddr}
+	handler.ServeDNS(conn, new(dns.Msg).SetQuestion("example.org.", dns.TypeIXFR))
+	if len(conn.msgs) != 1 || conn.msgs[0].Rcode != dns.RcodeFormatError {
+		t.Fatalf("expected FORMERR, got %v", conn.msgs)
+	}
+
+	if !router.RemoveZone("example.org.") {
+		t.Fatal("failed to remove zone")
+	}
+	if _, ok := router.ixfr("example.org.", dns.ClassINET, 5); ok {
+		t.Fatal("journal is not removed along with the zone")
+	}
+	if len(router.loadJournals()) != 0 {
+		t.Fatal("journal is not removed along with the zone")
+	}
+}
+
+func TestTransferSize(t *testing.T) {
+	var records []string
+	for i := 0; i < 100; i++ {
+		records = append(records, fmt.Sprintf("big%d 3600 IN TXT \"%s\" \"%s\" \"%s\" \"%s\"", i,
+			strings.Repeat("a", 250), strings.Repeat("b", 250), strings.Repeat("c", 250), strings.Repeat("d", 250)))
+	}
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1, records...)), "example.org.", "stdin")
+
+	transfer := new(Transfer)
+	transfer.ACL, _ = ParseACL("127.0.0.1")
+	router.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+	handler := Classic(context.Background(), router)
+
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	serve := func(req *dns.Msg, addr net.Addr) (msgs []*dns.Msg, n int) {
+		conn := &testConn{remoteAddr: addr}
+		handler.ServeDNS(conn, req)
+		for _, m := range conn.msgs {
+			data, err := m.Pack()
+			if err != nil {
+				t.Fatalf("failed to pack: %v", err)
+			}
+			if len(data) > dns.MaxMsgSize {
+				t.Fatalf("message of %d bytes exceeds %d", len(data), dns.MaxMsgSize)
+			}
+			if m.Truncated {
+				t.Errorf("unexpected TC: %v", m)
+			}
+			if _, udp := addr.(*net.UDPAddr); udp && len(data) > dns.MinMsgSize && req.IsEdns0() == nil {
+				t.Errorf("message of %d bytes exceeds %d", len(data), dns.MinMsgSize)
+			}
+			n += len(m.Answer)
+		}
+		return conn.msgs, n
+	}
+
+	// 100 records of 1KB are split by size rather than MaxRecords
+	msgs, n := serve(new(dns.Msg).SetAxfr("example.org."), tcpAddr)
+	if len(msgs) < 2 || n != 102 {
+		t.Fatalf("unexpected AXFR of %d messages and %d records", len(msgs), n)
+	}
+
+	// a delta of 40 small records
+	var small []string
+	for i := 0; i < 40; i++ {
+		small = append(small, fmt.Sprintf("small%d 3600 IN TXT \"%s\"", i, strings.Repeat("x", 60)))
+	}
+	if _, err := router.ReloadZone(strings.NewReader(newTestZone("example.org.", 2, small...)), "example.org.", "stdin"); err != nil {
+		t.Fatal(err)
+	}
+	router.ReloadZone(strings.NewReader(newTestZone("example.org.", 3, small[:1]...)), "example.org.", "stdin")
+
+	ixfr := new(dns.Msg).SetIxfr("example.org.", 2, "ns.example.org.", "admin.example.org.")
+	if msgs, n := serve(ixfr, udpAddr); len(msgs) != 1 || n != 1 {
+		t.Errorf("expected the SOA only, got %v", msgs)
+	}
+	ixfr.SetEdns0(4096, false)
+	if msgs, n := serve(ixfr, udpAddr); len(msgs) != 1 || n != 43 {
+		t.Errorf("expected the delta within a message, got %d records of %d messages", n, len(msgs))
+	}
+}
+
+// startTestServer serves the handler over both UDP and TCP on a random port of localhost,
+// requests are verified with the TSIG secrets if any.
+func startTestServer(t *testing.T, h dns.Handler, secrets map[string]string) (addr string, shutdown func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	var servers []*dns.Server
+	for _, server := range []*dns.Server{
+		{Listener: l, Handler: h, TsigSecret: secrets},
+		{PacketConn: pc, Handler: h, TsigSecret: secrets},
+	} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		servers = append(servers, server)
+	}
+
+	return l.Addr().String(), func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	primary := New()
+	primary.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"a 3600 IN A 127.0.0.1", "b 3600 IN A 127.0.0.2")), "example.org.", "stdin")
+
+	var (
+		mu     sync.Mutex
+		qtypes []uint16
+	)
+	transfer := new(Transfer)
+	transfer.ACL, _ = ParseACL("127.0.0.1")
+	primary.Middleware = append([]Middleware{
+		func(h Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, req *Request) {
+				mu.Lock()
+				qtypes = append(qtypes, req.Question[0].Qtype)
+				mu.Unlock()
+				h.ServeDNS(w, req)
+			})
+		},
+		PanicHandler,
+		transfer.Handler,
+	}, DefaultScheme[1:]...)
+
+	addr, shutdown := startTestServer(t, Classic(context.Background(), primary), nil)
+	defer shutdown()
+
+	router := New()
+	secondary := NewSecondary(router, "example.org", addr)
+	expect := func(diffRecords int, types ...uint16) {
+		mu.Lock()
+		qtypes = nil
+		mu.Unlock()
+
+		diff, err := secondary.Refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diffRecords == 0 && diff != nil || diffRecords > 0 && (diff == nil || len(diff.Added)+len(diff.Removed) != diffRecords) {
+			t.Fatalf("unexpected diff: %+v", diff)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if fmt.Sprint(qtypes) != fmt.Sprint(types) {
+			t.Fatalf("expected queries %v, got %v", types, qtypes)
+		}
+	}
+	exists := func(name string) bool {
+		_, ok := router.Lookup(name, dns.ClassINET).Search(dns.TypeA).(RcodeHandler)
+		return !ok
+	}
+
+	expect(3, dns.TypeSOA, dns.TypeAXFR)
+	if !exists("a.example.org") || !exists("b.example.org") {
+		t.Fatal("zone is not transferred")
+	}
+	expect(0, dns.TypeSOA)
+
+	reload := func(serial uint32, records ...string) {
+		if _, err := primary.ReloadZone(strings.NewReader(newTestZone("example.org.", serial, records...)), "example.org.", "stdin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reload(2, "b 3600 IN A 127.0.0.2", "c 3600 IN A 127.0.0.3")
+	reload(3, "b 3600 IN A 127.0.0.2", "c 3600 IN A 127.0.0.3", "d 3600 IN A 127.0.0.4")
+	expect(5, dns.TypeSOA, dns.TypeIXFR)
+	if exists("a.example.org") || !exists("c.example.org") || !exists("d.example.org") {
+		t.Fatal("zone is not transferred incrementally")
+	}
+	if soa := router.zoneSOA("example.org.", dns.ClassINET); soa == nil || soa.Serial != 3 {
+		t.Fatalf("unexpected SOA: %v", soa)
+	}
+
+	// the secondary journals changes as well
+	if rrs, ok := router.ixfr("example.org.", dns.ClassINET, 1); !ok || len(rrs) != 5 {
+		t.Fatalf("unexpected journal: %v", rrs)
+	}
+
+	// falls back to AXFR in IXFR
+	primary.MaxJournal = -1
+	reload(4, "d 3600 IN A 127.0.0.4")
+	expect(4, dns.TypeSOA, dns.TypeIXFR)
+	if rrs, ok := router.ixfr("example.org.", dns.ClassINET, 3); !ok || len(rrs) != 4 {
+		t.Fatalf("unexpected journal: %v", rrs)
+	}
+	if exists("b.example.org") || exists("c.example.org") || !exists("d.example.org") {
+		t.Fatal("zone is not transferred")
+	}
+
+	// falls back to AXFR if the incremental changes are not applicable
+	primary.MaxJournal = 0
+	reload(5, "d 3600 IN A 127.0.0.4", "e 3600 IN A 127.0.0.5")
+	router.Remove("d.example.org", dns.ClassINET, dns.TypeA)
+	router.Handle("d.example.org 3600 IN A 127.0.0.4", nil)
+	reload(6, "e 3600 IN A 127.0.0.5")
+	expect(3, dns.TypeSOA, dns.TypeIXFR, dns.TypeAXFR)
+
+	// a zone of the SOA only in AXFR format
+	primary.MaxJournal = -1
+	reload(7)
+	expect(3, dns.TypeSOA, dns.TypeIXFR)
+	if soa := router.zoneSOA("example.org.", dns.ClassINET); soa == nil || soa.Serial != 7 || exists("e.example.org") {
+		t.Fatalf("unexpected SOA: %v", soa)
+	}
+}
+
+func TestSecondaryTimers(t *testing.T) {
+	primary := New()
+	primary.HandleZone(strings.NewReader(
+		"example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 1 1 2 3600"), "example.org.", "stdin")
+	transfer := new(Transfer)
+	transfer.ACL, _ = ParseACL("127.0.0.1")
+	primary.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+
+	addr, shutdown := startTestServer(t, Classic(context.Background(), primary), nil)
+
+	refreshed := make(chan error, 10)
+	router := New()
+	secondary := NewSecondary(router, "example.org.", addr)
+	secondary.Retry = time.Second
+	secondary.OnRefresh = func(diff *ZoneDiff, err error) {
+		refreshed <- err
+	}
+	secondary.Start()
+	defer secondary.Stop()
+
+	wait := func() error {
+		select {
+		case err := <-refreshed:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if router.zoneSOA("example.org.", dns.ClassINET) == nil {
+		t.Fatal("zone is not transferred")
+	}
+
+	// refreshed after 1s
+	primary.ReloadZone(strings.NewReader(
+		"example.org. 3600 IN SOA ns.example.org. admin.example.org. 2 1 1 2 3600"), "example.org.", "stdin")
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if soa := router.zoneSOA("example.org.", dns.ClassINET); soa == nil || soa.Serial != 2 {
+		t.Fatalf("unexpected SOA: %v", soa)
+	}
+
+	// expired after 2s
+	shutdown()
+	for router.zoneSOA("example.org.", dns.ClassINET) != nil {
+		if err := wait(); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+}
+
+func TestSecondaryMinInterval(t *testing.T) {
+	primary := New()
+	primary.HandleZone(strings.NewReader(
+		"example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 0 0 3600 3600"), "example.org.", "stdin")
+	transfer := new(Transfer)
+	transfer.ACL, _ = ParseACL("127.0.0.1")
+	primary.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+
+	addr, shutdown := startTestServer(t, Classic(context.Background(), primary), nil)
+	defer shutdown()
+
+	refreshed := make(chan error, 100)
+	secondary := NewSecondary(New(), "example.org.", addr)
+	secondary.OnRefresh = func(diff *ZoneDiff, err error) {
+		refreshed <- err
+	}
+	secondary.Start()
+	defer secondary.Stop()
+
+	select {
+	case err := <-refreshed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// zero refresh timer
+	select {
+	case <-refreshed:
+		t.Fatal("refreshed too early")
+	case <-time.After(MinSecondaryInterval / 2):
+	}
+}
+
+func TestNotify(t *testing.T) {
+	primary := New()
+	primary.HandleZone(strings.NewReader(newTestZone("example.org.", 1)), "example.org.", "stdin")
+	transfer := new(Transfer)
+	transfer.ACL, _ = ParseACL("127.0.0.1")
+	primary.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+
+	primaryAddr, shutdown := startTestServer(t, Classic(context.Background(), primary), nil)
+	defer shutdown()
+
+	refreshed := make(chan *ZoneDiff, 10)
+	router := New()
+	secondary := NewSecondary(router, "example.org.", primaryAddr)
+	secondary.OnRefresh = func(diff *ZoneDiff, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		refreshed <- diff
+	}
+	router.OpcodeHandler = map[int]Handler{dns.OpcodeNotify: NotifyHandler(secondary)}
+	handler := Classic(context.Background(), router)
+
+	addr, shutdown := startTestServer(t, handler, nil)
+	defer shutdown()
+
+	wait := func() *ZoneDiff {
+		select {
+		case diff := <-refreshed:
+			return diff
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	secondary.Start()
+	defer secondary.Stop()
+	if diff := wait(); diff == nil || diff.Serial != 1 {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+
+	notified := make(chan error, 10)
+	notifier := &Notifier{
+		Secondaries: map[string][]string{"example.org": {addr}},
+		OnNotify: func(origin, addr string, err error) {
+			notified <- err
+		},
+	}
+	var changes []string
+	primary.OnZoneChange = func(origin string) {
+		changes = append(changes, origin)
+		notifier.Notify(origin)
+	}
+
+	primary.Handle("www.example.org. 3600 IN A 127.0.0.1", nil)
+	if changes != nil {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	if _, err := primary.ReloadZone(strings.NewReader(newTestZone("example.org.", 2)), "example.org.", "stdin"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(changes) != "[example.org.]" {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	notifier.Wait()
+	if err := <-notified; err != nil {
+		t.Fatal(err)
+	}
+	if diff := wait(); diff == nil || diff.Serial != 2 {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+
+	tests := []struct {
+		qname string
+		addr  net.Addr
+		rcode int
+	}{
+		{"example.org.", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, dns.RcodeSuccess},
+		{"example.org.", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, dns.RcodeRefused},
+		{"example.com.", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, dns.RcodeNotAuth},
+	}
+	for _, test := range tests {
+		conn := &testConn{remoteAddr: test.addr}
+		handler.ServeDNS(conn, new(dns.Msg).SetNotify(test.qname))
+		if len(conn.msgs) != 1 || conn.msgs[0].Rcode != test.rcode || conn.msgs[0].Opcode != dns.OpcodeNotify {
+			t.Errorf("%s from %v: expected rcode %d, got %v", test.qname, test.addr, test.rcode, conn.msgs)
+		}
+	}
+	if diff := wait(); diff != nil {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+
+	// other opcodes are not implemented
+	conn := &testConn{remoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	handler.ServeDNS(conn, new(dns.Msg).SetUpdate("example.org."))
+	if len(conn.msgs) != 1 || conn.msgs[0].Rcode != dns.RcodeNotImplemented {
+		t.Fatalf("expected NOTIMP, got %v", conn.msgs)
+	}
+
+	// recovers from panics
+	panicking := New()
+	panicking.OpcodeHandler = map[int]Handler{dns.OpcodeUpdate: HandlerFunc(func(w ResponseWriter, req *Request) {
+		panic("update")
+	})}
+	conn = &testConn{remoteAddr: conn.remoteAddr}
+	Classic(context.Background(), panicking).ServeDNS(conn, new(dns.Msg).SetUpdate("example.org."))
+	if len(conn.msgs) != 1 || conn.msgs[0].Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %v", conn.msgs)
+	}
+
+	// no zone section
+	update := new(dns.Msg)
+	update.Opcode = dns.OpcodeUpdate
+	conn = &testConn{remoteAddr: conn.remoteAddr}
+	Classic(context.Background(), panicking).ServeDNS(conn, update)
+	if len(conn.msgs) != 1 || conn.msgs[0].Rcode != dns.RcodeFormatError {
+		t.Fatalf("expected FORMERR, got %v", conn.msgs)
+	}
+}
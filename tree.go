@@ -161,6 +161,9 @@ const (
 type nodeData struct {
 	handler classHandler
 	rrType  rrType
+
+	// nsec3 is the NSEC3 index if the node is an apex of NSEC3 signed zone
+	nsec3 *nsec3Index
 }
 
 func (p *nodeData) addHandler(h typeHandler) {
@@ -168,7 +171,33 @@ func (p *nodeData) addHandler(h typeHandler) {
 	if len(p.handler) > 1 {
 		sort.Sort(p.handler)
 	}
+	p.markType(h)
+}
+
+// removeHandler removes handlers matched by f and returns the number of removed.
+func (p *nodeData) removeHandler(f func(typeHandler) bool) int {
+	handler := p.handler[:0]
+	for _, h := range p.handler {
+		if !f(h) {
+			handler = append(handler, h)
+		}
+	}
+
+	removed := len(p.handler) - len(handler)
+	if removed > 0 {
+		for i := len(handler); i < len(p.handler); i++ {
+			p.handler[i] = typeHandler{}
+		}
+		p.handler = handler
+		p.rrType = 0
+		for _, h := range handler {
+			p.markType(h)
+		}
+	}
+	return removed
+}
 
+func (p *nodeData) markType(h typeHandler) {
 	originated := true
 	if a, ok := h.Handler.(Answer); ok {
 		if !strings.HasSuffix(a.Header().Name, h.Origin) {
@@ -206,6 +235,17 @@ type value struct {
 	cut bool
 	// zones is met zones from up to down while searching name
 	zones []milestone
+
+	// root and name are where the search started, for finding ancestors
+	root *node
+	name string
+}
+
+// ancestors returns nodes from the root down to the parent of the nearest node.
+func (v value) ancestors() []*node {
+	var path []*node
+	v.root.search(v.name, &path)
+	return path
 }
 
 // previous returns a previous node by canonical order
@@ -264,6 +304,12 @@ func (v value) previous() *node {
 		zone = v.zones[len(v.zones)-1].node
 	}
 
+	// ancestors of nearestNode are found only if going up
+	var (
+		ancestors []*node
+		depth     = -1
+	)
+
 up:
 	if nearestNode != nil && nearestName != "" {
 		c := nearestName[0]
@@ -327,13 +373,19 @@ up:
 		}
 
 		// finally go up
-		for nearestNode.parent != nil {
-			if nearestNode.parent == zone {
+		if depth == -1 {
+			ancestors = v.ancestors()
+			depth = len(ancestors)
+		}
+		for depth > 0 {
+			parent := ancestors[depth-1]
+			if parent == zone {
 				return zone
 			}
 
 			nearestName = nearestNode.name
-			nearestNode = nearestNode.parent
+			nearestNode = parent
+			depth--
 
 			if nearestName != "" {
 				goto up
@@ -371,7 +423,6 @@ type node struct {
 	maxParams uint8
 	indices   string
 	children  []*node
-	parent    *node
 	data      *nodeData
 	priority  uint32
 }
@@ -409,9 +460,53 @@ func (n *node) incrementChildPrio(pos int) int {
 	return newPos
 }
 
+// cow makes nodes writable by copying them upon first written, so that a
+// transaction changes only the nodes along the paths it writes, while the
+// untouched subtrees are shared with the published tree. It records nodes
+// created or copied by itself, which are written in place. A nil cow writes
+// every node in place.
+type cow map[*node]bool
+
+// own returns a writable n, which is a copy of n unless created by c.
+func (c cow) own(n *node) *node {
+	if c == nil || c[n] {
+		return n
+	}
+
+	m := *n
+	m.children = append([]*node(nil), n.children...)
+	if n.data != nil {
+		data := *n.data
+		data.handler = append(classHandler(nil), n.data.handler...)
+		m.data = &data
+	}
+	c[&m] = true
+	return &m
+}
+
+// ownChild replaces the i-th child of the writable n with a writable one, and returns it.
+func (c cow) ownChild(n *node, i int) *node {
+	child := c.own(n.children[i])
+	n.children[i] = child
+	return child
+}
+
+// mark records n as created by c.
+func (c cow) mark(n *node) *node {
+	if c != nil {
+		c[n] = true
+	}
+	return n
+}
+
 // addRoute adds a node with the given handler to the name.
 // Not concurrency-safe!
 func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
+	cow(nil).addRoute(n, name, allowDup, handler)
+}
+
+// addRoute is like node.addRoute, but writes nodes by c, where n is writable.
+func (c cow) addRoute(n *node, name string, allowDup bool, handler typeHandler) {
 	//var anonymousParent *node
 	fullName := name
 	n.priority++
@@ -437,23 +532,21 @@ func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
 
 			// Split edge
 			if i < len(n.name) {
-				child := &node{
+				child := c.mark(&node{
 					name:      n.name[i:],
 					wildChild: n.wildChild,
 					nType:     static,
 					indices:   n.indices,
 					children:  n.children,
-					parent:    n,
 					data:      n.data,
 					priority:  n.priority - 1,
-				}
+				})
 
 				// Update maxParams (max of all children)
 				for i := range child.children {
 					if child.children[i].maxParams > child.maxParams {
 						child.maxParams = child.children[i].maxParams
 					}
-					child.children[i].parent = child
 				}
 
 				n.children = []*node{child}
@@ -469,7 +562,7 @@ func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
 				name = name[i:]
 
 				if n.wildChild == namedWildChild {
-					n = n.children[0]
+					n = c.ownChild(n, 0)
 					n.priority++
 
 					// Update maxParams of the child node
@@ -500,18 +593,23 @@ func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
 					}
 				}
 
-				c := name[0]
+				b := name[0]
 
 				// dot after param
-				if n.nType == param && c == '.' && len(n.children) == 1 {
-					n = n.children[0]
+				if n.nType == param && b == '.' && len(n.children) == 1 {
+					n = c.ownChild(n, 0)
 					n.priority++
 					continue walk
 				}
 
 				// Check if a child with the next name byte exists
 				for i := 0; i < len(n.indices); i++ {
-					if c == n.indices[i] {
+					if b == n.indices[i] {
+						if n.wildChild != noWildChild {
+							c.ownChild(n, i+1)
+						} else {
+							c.ownChild(n, i)
+						}
 						i = n.incrementChildPrio(i)
 						n = n.children[i]
 						continue walk
@@ -519,13 +617,12 @@ func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
 				}
 
 				// Otherwise insert it
-				if c != ':' && c != '*' {
+				if b != ':' && b != '*' {
 					// []byte for proper unicode char conversion, see #65
-					n.indices += string([]byte{c})
-					child := &node{
+					n.indices += string([]byte{b})
+					child := c.mark(&node{
 						maxParams: numParams,
-						parent:    n,
-					}
+					})
 					n.children = append(n.children, child)
 					n.incrementChildPrio(len(n.indices) - 1)
 					n = child
@@ -535,11 +632,11 @@ func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
 						panic("a handle is already registered for name '" + fullName + "'")
 					}
 
-					child := n.children[0]
+					child := c.ownChild(n, 0)
 					child.data.addHandler(handler)
 					child.priority++
 				} else {
-					n.insertChild(numParams, name, fullName, handler)
+					c.insertChild(n, numParams, name, fullName, handler)
 				}
 				return
 
@@ -555,18 +652,211 @@ func (n *node) addRoute(name string, allowDup bool, handler typeHandler) {
 			return
 		}
 	} else { // Empty tree
-		n.insertChild(numParams, name, fullName, handler)
+		c.insertChild(n, numParams, name, fullName, handler)
 		n.nType = root
 	}
 }
 
-func (n *node) insertChild(numParams uint8, name, fullName string, handler typeHandler) {
+// findRoute returns the node which the given name has been added to,
+// named parameters and wildcards in name are compared literally.
+func (n *node) findRoute(name string) *node {
+	for {
+		if len(name) < len(n.name) || name[:len(n.name)] != n.name {
+			return nil
+		}
+
+		name = name[len(n.name):]
+		if name == "" {
+			return n
+		}
+
+		i := n.childIndex(name[0])
+		if i == -1 {
+			return nil
+		}
+		n = n.children[i]
+	}
+}
+
+// ownRoute is like findRoute, but makes nodes writable by c along the path,
+// and returns them from n, which is writable, to the node of the name.
+func (c cow) ownRoute(n *node, name string) []*node {
+	path := []*node{n}
+	for {
+		if len(name) < len(n.name) || name[:len(n.name)] != n.name {
+			return nil
+		}
+
+		name = name[len(n.name):]
+		if name == "" {
+			return path
+		}
+
+		i := n.childIndex(name[0])
+		if i == -1 {
+			return nil
+		}
+		n = c.ownChild(n, i)
+		path = append(path, n)
+	}
+}
+
+// childIndex returns the index of the child which the rest of a name starting
+// with the byte b is added to, or -1 if none.
+func (n *node) childIndex(b byte) int {
+	switch {
+	case n.wildChild == namedWildChild,
+		n.wildChild == anonymousWildChild && b == '*',
+		n.nType == param && b == '.' && len(n.children) == 1:
+		return 0
+	}
+
+	for i := 0; i < len(n.indices); i++ {
+		if b == n.indices[i] {
+			if n.wildChild != noWildChild {
+				// since indices doesn't contain wildcard, so use the next child
+				i++
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// removeRoute removes handlers matched by f from the given name, then prunes
+// the nodes left empty. It returns the number of removed handlers.
+// Not concurrency-safe!
+func (n *node) removeRoute(name string, f func(typeHandler) bool) int {
+	return cow(nil).removeRoute(n, name, f)
+}
+
+// removeRoute is like node.removeRoute, but writes nodes by c, where n is writable.
+func (c cow) removeRoute(n *node, name string, f func(typeHandler) bool) int {
+	if target := n.findRoute(name); target == nil || target.data == nil {
+		return 0
+	}
+
+	path := c.ownRoute(n, name)
+	target := path[len(path)-1]
+	removed := target.data.removeHandler(f)
+	if removed == 0 {
+		return 0
+	}
+
+	// every handler added increases priorities along the path once
+	for _, p := range path {
+		if p.priority > uint32(removed) {
+			p.priority -= uint32(removed)
+		} else {
+			p.priority = 0
+		}
+	}
+
+	if len(target.data.handler) == 0 {
+		target.data = nil
+		c.prune(path)
+	}
+	return removed
+}
+
+// prune removes the last node of the path and its ancestors which have neither
+// data nor children, then merges the rest one with its only child if possible.
+// Nodes of the path must be writable.
+func (c cow) prune(path []*node) {
+	i := len(path) - 1
+	n := path[i]
+	for n.data == nil && len(n.children) == 0 && i > 0 {
+		i--
+		path[i].removeChild(n)
+		n = path[i]
+	}
+
+	if n.data == nil && len(n.children) == 0 {
+		// the tree is empty now
+		*n = node{}
+		return
+	}
+
+	if n.data == nil && len(n.children) == 1 && n.wildChild == noWildChild &&
+		n.nType <= root && n.children[0].nType == static {
+		child := c.ownChild(n, 0)
+		n.name += child.name
+		n.wildChild = child.wildChild
+		n.indices = child.indices
+		n.children = child.children
+		n.data = child.data
+		n.priority = child.priority
+	}
+
+	for ; i >= 0; i-- {
+		n := path[i]
+		var maxParams uint8
+		for _, child := range n.children {
+			if child.maxParams > maxParams {
+				maxParams = child.maxParams
+			}
+		}
+		if n.nType > root && n.wildChild == noWildChild {
+			maxParams++
+		}
+		n.maxParams = maxParams
+	}
+}
+
+// removeChild detaches the given child from n.
+func (n *node) removeChild(child *node) {
+	for i := range n.children {
+		if n.children[i] != child {
+			continue
+		}
+
+		if n.wildChild != noWildChild && i == 0 {
+			n.wildChild = noWildChild
+		} else {
+			j := i
+			if n.wildChild != noWildChild {
+				j--
+			}
+			// the child of a param node might be not indexed
+			if j < len(n.indices) {
+				n.indices = n.indices[:j] + n.indices[j+1:]
+			}
+		}
+
+		copy(n.children[i:], n.children[i+1:])
+		n.children[len(n.children)-1] = nil
+		n.children = n.children[:len(n.children)-1]
+		if len(n.children) == 0 {
+			n.children = nil
+		}
+		return
+	}
+}
+
+// walk calls fn for n and every descendant of n.
+func (n *node) walk(fn func(*node)) {
+	fn(n)
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
+
+// walkName is like walk, but also passes the name that each node has been
+// added with, given the one of n.
+func (n *node) walkName(name string, fn func(string, *node)) {
+	fn(name, n)
+	for _, child := range n.children {
+		child.walkName(name+child.name, fn)
+	}
+}
+
+func (c cow) insertChild(n *node, numParams uint8, name, fullName string, handler typeHandler) {
 	var offset int // already handled bytes of the name
 
 	// find prefix until first wildcard (beginning with ':'' or '*'')
 	for i, max := 0, len(name); numParams > 0; i++ {
-		c := name[i]
-		if c != ':' && c != '*' {
+		b := name[i]
+		if b != ':' && b != '*' {
 			continue
 		}
 
@@ -584,19 +874,18 @@ func (n *node) insertChild(numParams uint8, name, fullName string, handler typeH
 		}
 
 		// anonymous wildcard
-		if c == '*' && end == max && strings.HasSuffix(fullName, ".*") {
+		if b == '*' && end == max && strings.HasSuffix(fullName, ".*") {
 			// split name at the beginning of the wildcard
 			if i > 0 {
 				n.name = name[offset:i]
 				offset = i
 			}
 
-			child := &node{
+			child := c.mark(&node{
 				nType:     anonymousCatchAll,
 				maxParams: numParams,
 				priority:  1,
-				parent:    n,
-			}
+			})
 			n.children = append([]*node{child}, n.children...)
 			n.wildChild = anonymousWildChild
 			n = child
@@ -615,18 +904,17 @@ func (n *node) insertChild(numParams uint8, name, fullName string, handler typeH
 			panic("wildcards must be named with a non-empty name in name '" + fullName + "'")
 		}
 
-		if c == ':' { // param
+		if b == ':' { // param
 			// split name at the beginning of the wildcard
 			if i > 0 {
 				n.name = name[offset:i]
 				offset = i
 			}
 
-			child := &node{
+			child := c.mark(&node{
 				nType:     param,
 				maxParams: numParams,
-				parent:    n,
-			}
+			})
 			n.children = []*node{child}
 			n.wildChild = namedWildChild
 			n = child
@@ -639,11 +927,10 @@ func (n *node) insertChild(numParams uint8, name, fullName string, handler typeH
 				n.name = name[offset:end]
 				offset = end
 
-				child := &node{
+				child := c.mark(&node{
 					maxParams: numParams,
 					priority:  1,
-					parent:    n,
-				}
+				})
 				n.children = []*node{child}
 				n = child
 			}
@@ -666,26 +953,24 @@ func (n *node) insertChild(numParams uint8, name, fullName string, handler typeH
 			n.name = name[offset:i]
 
 			// first node: catchAll node with empty name
-			child := &node{
+			child := c.mark(&node{
 				wildChild: namedWildChild,
 				nType:     catchAll,
 				maxParams: 1,
-				parent:    n,
-			}
+			})
 			n.children = []*node{child}
 			n.indices = string(name[i])
 			n = child
 			n.priority++
 
 			// second node: node holding the variable
-			child = &node{
+			child = c.mark(&node{
 				name:      name[i:],
 				nType:     catchAll,
 				maxParams: 1,
 				data:      new(nodeData),
 				priority:  1,
-				parent:    n,
-			}
+			})
 			child.data.addHandler(handler)
 			n.children = []*node{child}
 
@@ -702,11 +987,20 @@ func (n *node) insertChild(numParams uint8, name, fullName string, handler typeH
 }
 
 // Returns the handler registered with the given name (key).
-func (n *node) getValue(name string) (v value) {
+func (n *node) getValue(name string) value {
+	return n.search(name, nil)
+}
+
+// search is like getValue, but also records ancestors of the nearest node
+// into ancestors if it is not nil.
+func (n *node) search(name string, ancestors *[]*node) (v value) {
 	var (
 		end int
 		p   Params
 
+		// path is nodes from the root down to the parent of n, if recording
+		path []*node
+
 		// TODO: Is there an real case that an asterisk across multiple zones?
 
 		// fallback variables are relative to anonymous wildcards.
@@ -714,6 +1008,10 @@ func (n *node) getValue(name string) (v value) {
 		fallbackNode   *node
 		fallbackName   string
 		fallbackParams Params
+		fallbackDepth  int
+
+		// whether n.name has been stripped from name, i.e. no child of n matches
+		consumed bool
 	)
 
 	defer func() {
@@ -733,7 +1031,9 @@ func (n *node) getValue(name string) (v value) {
 			switch n.nType {
 			case static, root:
 				l := len(name)
-				v.cut = l < len(n.name) && n.name[l] == '.' && n.name[:l] == name
+				v.cut = !consumed && (l < len(n.name) && n.name[l] == '.' && n.name[:l] == name ||
+					// an empty non-terminal node with children
+					name == n.name && strings.IndexByte(n.indices, '.') != -1)
 			case param:
 				// both name and n.name have no child.
 				v.cut = end == len(name)
@@ -741,6 +1041,7 @@ func (n *node) getValue(name string) (v value) {
 		}
 	}()
 
+	v.root, v.name = n, name
 	v.nearest.node = n
 	v.nearest.name = name
 
@@ -748,13 +1049,16 @@ walk: // outer loop for walking the tree
 	for {
 		if len(name) > len(n.name) && name[:len(n.name)] == n.name {
 			if n.wildChild == anonymousWildChild {
-				fallbackNode, fallbackName, fallbackParams = n, name, p
+				fallbackNode, fallbackName, fallbackParams, fallbackDepth = n, name, p, len(path)
 			}
 
 			name = name[len(n.name):]
 
 			if !fallback {
 				v.nearest.node, v.nearest.params, v.nearest.name = n, p, name
+				if ancestors != nil {
+					*ancestors = append((*ancestors)[:0], path...)
+				}
 			}
 
 			if n.data != nil && strings.HasPrefix(name, ".") {
@@ -784,6 +1088,9 @@ walk: // outer loop for walking the tree
 
 				for i := 0; i < len(n.indices); i++ {
 					if c == n.indices[i] {
+						if ancestors != nil {
+							path = append(path, n)
+						}
 						if n.wildChild != noWildChild {
 							// since indices doesn't contain wildcard, so use the next child
 							n = n.children[i+1]
@@ -797,12 +1104,17 @@ walk: // outer loop for walking the tree
 				// Nothing found.
 				if fallbackNode != nil && !fallback {
 					n, name, p, fallback = fallbackNode, fallbackName, fallbackParams, true
+					path = path[:fallbackDepth]
 					continue walk
 				}
+				consumed = true
 				return
 			}
 
 			// handle wildcard child
+			if ancestors != nil {
+				path = append(path, n)
+			}
 			n = n.children[0]
 			switch n.nType {
 			case param:
@@ -845,6 +1157,10 @@ walk: // outer loop for walking the tree
 					if len(n.children) > 0 {
 						name = name[end:]
 						v.nearest.node, v.nearest.params, v.nearest.name = n, p, name
+						if ancestors != nil {
+							*ancestors = append((*ancestors)[:0], path...)
+							path = append(path, n)
+						}
 						n = n.children[0]
 						continue walk
 					}
@@ -852,6 +1168,7 @@ walk: // outer loop for walking the tree
 					// ... but we can't
 					if fallbackNode != nil {
 						n, name, p, fallback = fallbackNode, fallbackName, fallbackParams, true
+						path = path[:fallbackDepth]
 						continue walk
 					}
 					return
@@ -926,6 +1243,7 @@ walk: // outer loop for walking the tree
 
 			if fallbackNode != nil {
 				n, name, p, fallback = fallbackNode, fallbackName, fallbackParams, true
+				path = path[:fallbackDepth]
 				continue walk
 			}
 		}
@@ -123,18 +123,6 @@ func checkMaxParams(t *testing.T, n *node) uint8 {
 	return maxParams
 }
 
-func checkParent(t *testing.T, n *node) {
-	for _, child := range n.children {
-		checkParent(t, child)
-		if child.parent != n {
-			t.Errorf(
-				"parent mismatch for node '%s': is %p, should be %p",
-				child.name, child.parent, n,
-			)
-		}
-	}
-}
-
 func TestCountParams(t *testing.T) {
 	if countParams(".name.:param1.static.*catch-all") != 2 {
 		t.Fail()
@@ -184,7 +172,81 @@ func TestTreeAddAndGet(t *testing.T) {
 
 	checkPriorities(t, tree)
 	checkMaxParams(t, tree)
-	checkParent(t, tree)
+}
+
+func TestTreeEmptyNonTerminal(t *testing.T) {
+	tree := &node{}
+
+	routes := [...]string{
+		".org.example",
+		".org.example.a",
+		".org.example.b.x.y",
+		".org.example.b.y.aa.aa",
+	}
+	for _, route := range routes {
+		tree.addRoute(route, false, fakeHandler(route))
+	}
+
+	checkRequests(t, tree, testRequests{
+		{".org", true, "", nil, nil, true},
+		{".org.example.b", true, "", nil, nil, true},
+		{".org.example.b.x", true, "", nil, nil, true},
+		{".org.example.b.y.aa", true, "", nil, nil, true},
+		{".org.example.b.b", true, "", nil, nil, false},
+		{".org.example.b.y.a", true, "", nil, nil, false},
+		{".org.example.b.x.y.z", true, "", nil, nil, false},
+		{".org.example.c", true, "", nil, nil, false},
+	})
+}
+
+func TestTreeCopyOnWrite(t *testing.T) {
+	tree := &node{}
+
+	routes := [...]string{
+		".",
+		".org.example",
+		".org.example.*",
+		".org.example.www",
+		".org.example.www.:user",
+		".com.example.*name",
+	}
+	for _, route := range routes {
+		tree.addRoute(route, false, fakeHandler(route))
+	}
+
+	c := make(cow)
+	clone := c.own(tree)
+	c.addRoute(clone, ".org.example.ftp", false, fakeHandler(".org.example.ftp"))
+	checkPriorities(t, clone)
+	checkMaxParams(t, clone)
+
+	checkRequests(t, tree, testRequests{
+		{".org.example.ftp", false, ".org.example.*", nil, Params{Param{"", "ftp"}}, false},
+	})
+	checkRequests(t, clone, testRequests{
+		{".org.example.ftp", false, ".org.example.ftp", nil, nil, false},
+		{".org.example.www", false, ".org.example.www", nil, nil, false},
+		{".org.example.www.joe", false, ".org.example.www.:user", nil, Params{Param{"user", "joe"}}, false},
+		{".com.example.a.b", false, ".com.example.*name", nil, Params{Param{"name", ".a.b"}}, false},
+	})
+
+	if tree.findRoute(".com.example.*name") != clone.findRoute(".com.example.*name") {
+		t.Error("untouched subtree should be shared")
+	}
+
+	if c.removeRoute(clone, ".org.example.www.:user", func(typeHandler) bool { return true }) != 1 {
+		t.Error("expected 1 removed route")
+	}
+	checkPriorities(t, clone)
+	checkMaxParams(t, clone)
+	checkCompact(t, clone)
+
+	checkRequests(t, tree, testRequests{
+		{".org.example.www.joe", false, ".org.example.www.:user", nil, Params{Param{"user", "joe"}}, false},
+	})
+	checkRequests(t, clone, testRequests{
+		{".org.example.www.joe", false, ".org.example.*", nil, Params{Param{"", "www.joe"}}, false},
+	})
 }
 
 func TestTreeWildcard(t *testing.T) {
@@ -249,7 +311,157 @@ func TestTreeWildcard(t *testing.T) {
 
 	checkPriorities(t, tree)
 	checkMaxParams(t, tree)
-	checkParent(t, tree)
+}
+
+// checkCompact checks if there is a node could be pruned or merged.
+func checkCompact(t *testing.T, n *node) {
+	for _, child := range n.children {
+		checkCompact(t, child)
+		if child.data == nil && len(child.children) == 0 {
+			t.Errorf("empty node '%s' under '%s'", child.name, n.name)
+		}
+	}
+
+	if n.data == nil && len(n.children) == 1 && n.wildChild == noWildChild &&
+		n.nType <= root && n.children[0].nType == static {
+		t.Errorf("node '%s' should be merged with its only child '%s'", n.name, n.children[0].name)
+	}
+}
+
+func TestTreeRemove(t *testing.T) {
+	routes := [...]string{
+		".",
+		".cmd.:tool.:sub",
+		".cmd.:tool.",
+		".src.*filename",
+		".search.",
+		".search.:query",
+		".doc",
+		".doc.*",
+		".doc.go_faq.html",
+		".doc.go1.html",
+		".doc.go1.html.*",
+		".org.example",
+		".org.example.a",
+		".org.example.ab",
+		".org.example.b",
+		".org.example.b.c",
+	}
+
+	tree := &node{}
+	for _, route := range routes {
+		tree.addRoute(route, false, fakeHandler(route))
+	}
+
+	any := func(typeHandler) bool { return true }
+
+	if n := tree.removeRoute(".org.example.c", any); n != 0 {
+		t.Fatalf("removed %d handlers from an unregistered name", n)
+	}
+	if n := tree.removeRoute(".cmd.tool", any); n != 0 {
+		t.Fatalf("removed %d handlers by a parameter value", n)
+	}
+
+	for _, route := range []string{
+		".org.example.ab",
+		".org.example.b",
+		".doc.*",
+		".cmd.:tool.:sub",
+		".src.*filename",
+		".search.:query",
+		".doc.go1.html",
+	} {
+		if n := tree.removeRoute(route, any); n != 1 {
+			t.Fatalf("removed %d handlers from '%s'", n, route)
+		}
+	}
+
+	//printChildren(tree, "")
+
+	checkRequests(t, tree, testRequests{
+		{".", false, ".", nil, nil, false},
+		{".cmd.test.", false, ".cmd.:tool.", nil, Params{Param{"tool", "test"}}, false},
+		{".cmd.test.3", true, "", nil, Params{Param{"tool", "test"}}, false},
+		{".src.some.file.png", true, "", nil, nil, false},
+		{".search.", false, ".search.", nil, nil, false},
+		{".search.x", true, "", nil, nil, false},
+		{".doc", false, ".doc", nil, nil, false},
+		{".doc.go1", true, "", nil, nil, true},
+		{".doc.go1.html", true, "", nil, nil, true},
+		{".doc.go1.html.x", false, ".doc.go1.html.*", nil, Params{Param{"", "x"}}, false},
+		{".doc.go_faq.html", false, ".doc.go_faq.html", nil, nil, false},
+		{".org.example", false, ".org.example", nil, nil, false},
+		{".org.example.a", false, ".org.example.a", nil, nil, false},
+		{".org.example.ab", true, "", nil, nil, false},
+		{".org.example.b", true, "", nil, nil, true},
+		{".org.example.b.c", false, ".org.example.b.c", nil, nil, false},
+	})
+
+	checkPriorities(t, tree)
+	checkMaxParams(t, tree)
+	checkCompact(t, tree)
+
+	for _, route := range routes {
+		tree.removeRoute(route, any)
+	}
+	if tree.name != "" || tree.data != nil || len(tree.children) != 0 || tree.priority != 0 {
+		t.Fatalf("expected an empty tree, got '%s' with %d children", tree.name, len(tree.children))
+	}
+
+	// empty tree is reusable
+	tree.addRoute(".org.example", false, fakeHandler(".org.example"))
+	checkRequests(t, tree, testRequests{
+		{".org.example", false, ".org.example", nil, nil, false},
+	})
+}
+
+func TestTreeRemoveZone(t *testing.T) {
+	tree := &node{}
+
+	routes := [...]struct {
+		name  string
+		qtype uint16
+	}{
+		{".org.example", dns.TypeSOA},
+		{".org.example", dns.TypeNS},
+		{".org.example", dns.TypeA},
+		{".org.example.c.d", dns.TypeNS},
+		{".org.example.c.d", dns.TypeA},
+		{".org.example.d", dns.TypeDNAME},
+		{".org.example.d", dns.TypeA},
+	}
+
+	for _, route := range routes {
+		h := fakeHandler(route.name)
+		h.Qtype = route.qtype
+		tree.addRoute(route.name, true, h)
+	}
+
+	byType := func(qtype uint16) func(typeHandler) bool {
+		return func(h typeHandler) bool { return h.Qtype == qtype }
+	}
+
+	tree.removeRoute(".org.example.c.d", byType(dns.TypeNS))
+	tree.removeRoute(".org.example.d", byType(dns.TypeDNAME))
+
+	checkRequests(t, tree, testRequests{
+		{".org.example.c.d", false, ".org.example.c.d", []string{".org.example"}, nil, false},
+		{".org.example.c.d.e", true, "", []string{".org.example"}, nil, false},
+		{".org.example.d.e", true, "", []string{".org.example"}, nil, false},
+	})
+
+	tree.removeRoute(".org.example", byType(dns.TypeSOA))
+	if v := tree.getValue(".org.example"); v.node.data.rrType != rrNs {
+		t.Fatalf("expected NS flag only, got %v", v.node.data.rrType)
+	}
+	tree.removeRoute(".org.example", byType(dns.TypeNS))
+	if v := tree.getValue(".org.example.a"); v.zones != nil {
+		t.Fatalf("expected no zones, got %d", len(v.zones))
+	}
+
+	checkPriorities(t, tree)
+	checkMaxParams(t, tree)
+	checkCompact(t, tree)
 }
 
 func catchPanic(testFunc func()) (recv interface{}) {
@@ -0,0 +1,214 @@
+package dnsrouter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTsigFudge is the default permitted error in seconds of TSIG signing time.
+const DefaultTsigFudge = 300
+
+// TsigKey is a shared secret of TSIG (https://tools.ietf.org/html/rfc8945).
+type TsigKey struct {
+	// Name of the key, e.g. "transfer.example.org.".
+	Name string
+
+	// Algorithm of the key, e.g. dns.HmacSHA256.
+	Algorithm string
+
+	// Secret is the base64 encoded secret.
+	Secret string
+}
+
+// TsigKeys is a key store indexed by canonical key names.
+type TsigKeys map[string]TsigKey
+
+// NewTsigKeys creates a key store from keys.
+func NewTsigKeys(keys ...TsigKey) TsigKeys {
+	m := make(TsigKeys, len(keys))
+	for _, key := range keys {
+		key.Name = strings.ToLower(dns.Fqdn(key.Name))
+		key.Algorithm = strings.ToLower(dns.Fqdn(key.Algorithm))
+		m[key.Name] = key
+	}
+	return m
+}
+
+// Lookup returns the key of the name.
+func (k TsigKeys) Lookup(name string) (TsigKey, bool) {
+	key, ok := k[strings.ToLower(dns.Fqdn(name))]
+	return key, ok
+}
+
+// Secrets returns the secrets keyed by names, which is suitable for the
+// TsigSecret of github.com/miekg/dns.Server and Client.
+func (k TsigKeys) Secrets() map[string]string {
+	m := make(map[string]string, len(k))
+	for name, key := range k {
+		m[name] = key.Secret
+	}
+	return m
+}
+
+type tsigContextKeyType int
+
+// TsigContextKey is used to get the name of the TSIG key authenticated the
+// request from Request context.
+const TsigContextKey tsigContextKeyType = 2
+
+// Tsig authenticates requests and signs responses by TSIG.
+// Since a signature covers the wire format, which is not preserved in Request,
+// requests are verified by github.com/miekg/dns.Server, which must be
+// configured by Configure before serving, e.g.
+//
+//	tsig.Configure(server)
+//	server.Handler = Classic(ctx, tsig.Handler(router))
+//
+// so that the middleware is only available if the handler is served by Classic.
+// A server without the keys doesn't verify requests at all, so signed requests
+// are rejected with BADKEY until Configure is called.
+// Wrapping a Router rather than chaining into Router.Middleware also covers
+// the handlers of Router.OpcodeHandler, e.g. Update.
+type Tsig struct {
+	// Keys is the key store.
+	Keys TsigKeys
+
+	// Required refuses requests without TSIG.
+	Required bool
+
+	// Fudge is the permitted error in seconds of signing time in responses, if
+	// it is zero then defaults to DefaultTsigFudge.
+	Fudge uint16
+
+	configured bool
+}
+
+// Configure sets the secrets of Keys to the server verifying requests for the
+// middleware. Keys changed afterwards require configuring the server again.
+func (t *Tsig) Configure(srv *dns.Server) {
+	srv.TsigSecret = t.Keys.Secrets()
+	t.configured = true
+}
+
+// Handler is a middleware verifying signed requests and signing their
+// responses. A request failed to be verified is responded with NOTAUTH and
+// the TSIG error BADKEY, BADSIG or BADTIME, otherwise it is passed to h with
+// the key name within the context.
+func (t *Tsig) Handler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		rr := req.IsTsig()
+		if rr == nil {
+			if t.Required {
+				w.Msg().Rcode = dns.RcodeRefused
+				return
+			}
+			h.ServeDNS(w, req)
+			return
+		}
+
+		status := tsigStatus(w)
+		if status == ErrNoConn {
+			w.Msg().Rcode = dns.RcodeNotAuth
+			return
+		}
+
+		key, ok := t.Keys.Lookup(rr.Hdr.Name)
+		if !ok || !equalName(key.Algorithm, rr.Algorithm) || !t.configured {
+			// a nil status is not a verification without the keys in the server
+			t.reject(w, req, rr, dns.RcodeBadKey)
+			return
+		}
+		switch status {
+		case nil:
+		case dns.ErrTime:
+			t.reject(w, req, rr, dns.RcodeBadTime)
+			return
+		case dns.ErrKeyAlg:
+			// the key or its algorithm is unknown to the server
+			t.reject(w, req, rr, dns.RcodeBadKey)
+			return
+		default:
+			t.reject(w, req, rr, dns.RcodeBadSig)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), TsigContextKey, key.Name)
+		h.ServeDNS(w, req.WithContext(ctx))
+		if isHijacked(w) {
+			return
+		}
+
+		result := w.Msg()
+		result.Extra = append(result.Extra, newTsig(rr, t.Fudge))
+	})
+}
+
+// reject responds a TSIG error without MAC. Though a BADTIME is supposed to be
+// signed, github.com/miekg/dns.Server drops the error while signing.
+func (t *Tsig) reject(w ResponseWriter, req *Request, rr *dns.TSIG, code uint16) {
+	conn := hijack(w)
+	if conn == nil {
+		// unable to write an unsigned error
+		w.Msg().Rcode = dns.RcodeNotAuth
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req.Msg, dns.RcodeNotAuth)
+
+	sig := newTsig(rr, t.Fudge)
+	sig.Error = code
+	if code == dns.RcodeBadTime {
+		sig.TimeSigned = rr.TimeSigned
+		sig.OtherData = fmt.Sprintf("%012x", time.Now().Unix())
+		sig.OtherLen = uint16(len(sig.OtherData) / 2)
+	}
+	m.Extra = append(m.Extra, sig)
+
+	data, err := m.Pack()
+	if err == nil {
+		_, err = conn.Write(data)
+	}
+	if err != nil {
+		log.Println("dns.Write error:", err)
+	}
+}
+
+// newTsig makes a TSIG of response to the request TSIG, which is signed while
+// written by github.com/miekg/dns.Server.
+func newTsig(rr *dns.TSIG, fudge uint16) *dns.TSIG {
+	if fudge == 0 {
+		fudge = DefaultTsigFudge
+	}
+
+	sig := new(dns.TSIG)
+	sig.Hdr = dns.RR_Header{Name: rr.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY}
+	sig.Algorithm = rr.Algorithm
+	sig.Fudge = fudge
+	sig.TimeSigned = uint64(time.Now().Unix())
+	sig.OrigId = rr.OrigId
+	return sig
+}
+
+// tsigKeyName returns the name of the key authenticated the request by Tsig.
+func tsigKeyName(req *Request) string {
+	name, _ := req.Context().Value(TsigContextKey).(string)
+	return name
+}
+
+// tsigAllowed reports whether the request is authenticated by any of keys.
+func tsigAllowed(req *Request, keys []string) bool {
+	if name := tsigKeyName(req); name != "" {
+		for _, key := range keys {
+			if equalName(key, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
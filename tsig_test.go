@@ -0,0 +1,171 @@
+package dnsrouter
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTsig(t *testing.T) {
+	keys := NewTsigKeys(
+		TsigKey{Name: "Key.Example.Org", Algorithm: dns.HmacSHA256, Secret: base64.StdEncoding.EncodeToString([]byte("secret"))},
+		TsigKey{Name: "other.example.org.", Algorithm: dns.HmacSHA1, Secret: base64.StdEncoding.EncodeToString([]byte("other"))},
+	)
+	if key, ok := keys.Lookup("KEY.example.org."); !ok || key.Name != "key.example.org." || key.Algorithm != dns.HmacSHA256 {
+		t.Fatalf("unexpected key: %v", key)
+	}
+
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"a 3600 IN A 127.0.0.1", "b 3600 IN A 127.0.0.2")), "example.org.", "stdin")
+
+	transfer := &Transfer{Keys: []string{"key.example.org."}, MaxRecords: 2}
+	router.Middleware = append([]Middleware{PanicHandler, transfer.Handler}, DefaultScheme[1:]...)
+	router.OpcodeHandler = map[int]Handler{
+		dns.OpcodeUpdate: &Update{Keys: []string{"key.example.org."}},
+	}
+
+	tsig := &Tsig{Keys: keys}
+	srv := new(dns.Server)
+	tsig.Configure(srv)
+	addr, shutdown := startTestServer(t, Classic(context.Background(), tsig.Handler(router)), srv.TsigSecret)
+	defer shutdown()
+
+	exchange := func(m *dns.Msg, key, algorithm, secret string, signed int64) *dns.Msg {
+		c := new(dns.Client)
+		if key != "" {
+			c.TsigSecret = map[string]string{key: base64.StdEncoding.EncodeToString([]byte(secret))}
+			m.SetTsig(key, algorithm, DefaultTsigFudge, signed)
+		}
+		r, _, err := c.Exchange(m, addr)
+		if r == nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	now := time.Now().Unix()
+
+	// unsigned
+	r := exchange(new(dns.Msg).SetQuestion("a.example.org.", dns.TypeA), "", "", "", 0)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.IsTsig() != nil {
+		t.Fatalf("unexpected unsigned response: %v", r)
+	}
+
+	// signed
+	r = exchange(new(dns.Msg).SetQuestion("a.example.org.", dns.TypeA), "key.example.org.", dns.HmacSHA256, "secret", now)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.IsTsig() == nil || r.IsTsig().Error != dns.RcodeSuccess {
+		t.Fatalf("unexpected signed response: %v", r)
+	}
+
+	tests := []struct {
+		key, algorithm, secret string
+		signed                 int64
+		code                   uint16
+	}{
+		{"key.example.org.", dns.HmacSHA256, "bad", now, dns.RcodeBadSig},
+		{"key.example.org.", dns.HmacSHA1, "secret", now, dns.RcodeBadKey},
+		{"unknown.example.org.", dns.HmacSHA256, "secret", now, dns.RcodeBadKey},
+		{"key.example.org.", dns.HmacSHA256, "secret", now - 3600, dns.RcodeBadTime},
+	}
+	for i, test := range tests {
+		r := exchange(new(dns.Msg).SetQuestion("a.example.org.", dns.TypeA), test.key, test.algorithm, test.secret, test.signed)
+		sig := r.IsTsig()
+		if r.Rcode != dns.RcodeNotAuth || len(r.Answer) != 0 || sig == nil || sig.Error != test.code {
+			t.Errorf("%d: unexpected response: %v", i, r)
+			continue
+		}
+		if sig.MAC != "" {
+			t.Errorf("%d: unexpected signed error: %v", i, sig)
+		}
+		if test.code == dns.RcodeBadTime && (sig.TimeSigned != uint64(test.signed) || sig.OtherLen != 6) {
+			t.Errorf("%d: unexpected BADTIME: %v", i, sig)
+		}
+	}
+
+	// updates are allowed by the key
+	m := new(dns.Msg).SetUpdate("example.org.")
+	m.Insert([]dns.RR{a("c.example.org. 3600 IN A 127.0.0.3")})
+	if r := exchange(m, "", "", "", 0); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("unexpected unsigned update: %v", r)
+	}
+	m = new(dns.Msg).SetUpdate("example.org.")
+	m.Insert([]dns.RR{a("c.example.org. 3600 IN A 127.0.0.3")})
+	if r := exchange(m, "other.example.org.", dns.HmacSHA1, "other", now); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("unexpected update by other key: %v", r)
+	}
+	m = new(dns.Msg).SetUpdate("example.org.")
+	m.Insert([]dns.RR{a("c.example.org. 3600 IN A 127.0.0.3")})
+	if r := exchange(m, "key.example.org.", dns.HmacSHA256, "secret", now); r.Rcode != dns.RcodeSuccess || r.IsTsig() == nil {
+		t.Fatalf("unexpected update: %v", r)
+	}
+
+	// transfers are signed in every message
+	tr := &dns.Transfer{TsigSecret: map[string]string{"key.example.org.": base64.StdEncoding.EncodeToString([]byte("secret"))}}
+	m = new(dns.Msg).SetAxfr("example.org.")
+	m.SetTsig("key.example.org.", dns.HmacSHA256, DefaultTsigFudge, time.Now().Unix())
+	c, err := tr.In(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n, envelopes int
+	for e := range c {
+		if e.Error != nil {
+			t.Fatal(e.Error)
+		}
+		n += len(e.RR)
+		envelopes++
+	}
+	if n != 5 || envelopes != 3 {
+		t.Fatalf("unexpected transfer: %d records in %d envelopes", n, envelopes)
+	}
+
+	tr = new(dns.Transfer)
+	c, err = tr.In(new(dns.Msg).SetAxfr("example.org."), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-c; e.Error == nil {
+		t.Fatal("expected an error of unsigned transfer")
+	}
+
+	// unsigned requests are refused if required
+	required := &Tsig{Keys: keys, Required: true}
+	required.Configure(srv)
+	addr, shutdown = startTestServer(t, Classic(context.Background(), required.Handler(router)), srv.TsigSecret)
+	defer shutdown()
+	if r := exchange(new(dns.Msg).SetQuestion("a.example.org.", dns.TypeA), "", "", "", 0); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("unexpected unsigned response: %v", r)
+	}
+	if r := exchange(new(dns.Msg).SetQuestion("a.example.org.", dns.TypeA), "key.example.org.", dns.HmacSHA256, "secret", now); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected signed response: %v", r)
+	}
+
+	// nothing is verified by a server without secrets
+	unconfigured := &Tsig{Keys: keys}
+	addr, shutdown = startTestServer(t, Classic(context.Background(), unconfigured.Handler(router)), nil)
+	defer shutdown()
+	for _, secret := range []string{"bad", "secret"} {
+		m = new(dns.Msg).SetUpdate("example.org.")
+		m.Insert([]dns.RR{a("d.example.org. 3600 IN A 127.0.0.4")})
+		r := exchange(m, "key.example.org.", dns.HmacSHA256, secret, now)
+		if sig := r.IsTsig(); r.Rcode != dns.RcodeNotAuth || sig == nil || sig.Error != dns.RcodeBadKey {
+			t.Fatalf("unexpected update signed by %q: %v", secret, r)
+		}
+	}
+	if r := exchange(new(dns.Msg).SetQuestion("d.example.org.", dns.TypeA), "", "", "", 0); len(r.Answer) != 0 {
+		t.Fatalf("unexpected record updated by an unverified request: %v", r)
+	}
+
+	// not served by Classic
+	req := NewRequest("a.example.org.", dns.TypeA)
+	req.SetTsig("key.example.org.", dns.HmacSHA256, DefaultTsigFudge, now)
+	w := NewResponseWriter()
+	tsig.Handler(router).ServeDNS(w, req)
+	if w.Msg().Rcode != dns.RcodeNotAuth {
+		t.Fatalf("unexpected response: %v", w.Msg())
+	}
+}
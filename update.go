@@ -0,0 +1,360 @@
+package dnsrouter
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// updateStub is a Stub capable of dynamic update, which is implemented by Router.
+type updateStub interface {
+	applyUpdate(m *dns.Msg) (rcode int)
+}
+
+// Update serves dynamic updates (https://tools.ietf.org/html/rfc2136), which
+// should be registered into Router.OpcodeHandler with dns.OpcodeUpdate.
+// Prerequisites are evaluated and updates are applied upon the Router in a
+// single change, so that either all updates are visible or nothing is changed.
+// Records are added into the zone as if loaded by HandleZone, and the serial
+// of the zone is increased for any change unless a greater SOA is given.
+type Update struct {
+	// ACL and Keys match clients allowed to update, see ACL.
+	ACL  ACL
+	Keys []string
+}
+
+// ServeDNS implements Handler interface.
+func (u *Update) ServeDNS(w ResponseWriter, req *Request) {
+	result := w.Msg()
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		result.Rcode = dns.RcodeFormatError
+		return
+	}
+
+	if !u.ACL.ContainsAddr(remoteAddr(w)) && !tsigAllowed(req, u.Keys) {
+		result.Rcode = dns.RcodeRefused
+		return
+	}
+
+	var stub updateStub
+	if classValue := req.Context().Value(ClassContextKey); classValue != nil {
+		stub, _ = classValue.(Class).Stub().(updateStub)
+	}
+	if stub == nil {
+		result.Rcode = dns.RcodeRefused
+		return
+	}
+
+	result.Rcode = stub.applyUpdate(req.Msg)
+}
+
+// rcodeError aborts a change with the response code.
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return dns.RcodeToString[int(e)]
+}
+
+func (r *Router) applyUpdate(m *dns.Msg) int {
+	err := r.update(func(t *txn) error {
+		zone := m.Question[0]
+		soa, origin := t.apex(zone.Name, zone.Qclass)
+		if soa == nil {
+			return rcodeError(dns.RcodeNotAuth)
+		}
+
+		if rcode := t.checkPrerequisites(zone, m.Answer); rcode != dns.RcodeSuccess {
+			return rcodeError(rcode)
+		}
+		if rcode := prescanUpdates(zone, m.Ns); rcode != dns.RcodeSuccess {
+			return rcodeError(rcode)
+		}
+
+		changed, soaChanged, err := t.applyUpdates(zone, origin, m.Ns)
+		if err != nil {
+			return err
+		}
+		if changed && !soaChanged {
+			next := dns.Copy(soa).(*dns.SOA)
+			next.Serial++
+			t.replaceSOA(zone.Qclass, origin, soa, next)
+		}
+		return nil
+	})
+
+	switch e := err.(type) {
+	case nil:
+		return dns.RcodeSuccess
+	case rcodeError:
+		return int(e)
+	default:
+		return dns.RcodeServerFailure
+	}
+}
+
+// apex returns the SOA of the zone, as well as the origin it is loaded with.
+func (t *txn) apex(name string, qclass uint16) (*dns.SOA, string) {
+	n := t.node(name, qclass)
+	if n == nil {
+		return nil, ""
+	}
+	for _, h := range n.data.handler {
+		if a, ok := h.Handler.(Answer); ok {
+			if soa, ok := a.RR.(*dns.SOA); ok && equalName(soa.Hdr.Name, name) {
+				return soa, h.Origin
+			}
+		}
+	}
+	return nil, ""
+}
+
+// node returns the node with data which the name has been added to, or nil if not found.
+func (t *txn) node(name string, qclass uint16) *node {
+	root := t.trees[qclass]
+	if root == nil {
+		return nil
+	}
+	n := root.findRoute(newIndexableName(name))
+	if n == nil || n.data == nil {
+		return nil
+	}
+	return n
+}
+
+// rrset returns records of the type at the name, or all records if qtype is
+// dns.TypeANY. Besides, it reports whether any other handler exists.
+func (t *txn) rrset(name string, qclass, qtype uint16) (rrs []dns.RR, others bool) {
+	n := t.node(name, qclass)
+	if n == nil {
+		return nil, false
+	}
+	for _, h := range n.data.handler {
+		if qtype != dns.TypeANY && h.Qtype != qtype {
+			continue
+		}
+		if a, ok := h.Handler.(Answer); ok {
+			rrs = append(rrs, a.RR)
+		} else {
+			others = true
+		}
+	}
+	return
+}
+
+// checkPrerequisites evaluates the prerequisite section (https://tools.ietf.org/html/rfc2136#section-3.2)
+// literally, i.e. names are never matched by wildcards.
+func (t *txn) checkPrerequisites(zone dns.Question, prereqs []dns.RR) int {
+	type rrsetKey struct {
+		name  string
+		qtype uint16
+	}
+
+	var (
+		keys  []rrsetKey
+		temp  = make(map[rrsetKey][]dns.RR)
+		class = zone.Qclass
+	)
+
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone.Name, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			rrs, others := t.rrset(hdr.Name, class, hdr.Rrtype)
+			if len(rrs) == 0 && !others {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			rrs, others := t.rrset(hdr.Name, class, hdr.Rrtype)
+			if len(rrs) > 0 || others {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		case class:
+			key := rrsetKey{strings.ToLower(dns.Fqdn(hdr.Name)), hdr.Rrtype}
+			if _, ok := temp[key]; !ok {
+				keys = append(keys, key)
+			}
+			temp[key] = append(temp[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// value dependent
+	for _, key := range keys {
+		rrs, _ := t.rrset(key.name, class, key.qtype)
+		if !equalRRset(rrs, temp[key]) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// equalRRset reports whether two RRsets consist of same records regardless of TTL.
+func equalRRset(a, b []dns.RR) bool {
+	contains := func(l []dns.RR, rr dns.RR) bool {
+		for _, v := range l {
+			if equalRecord(v, rr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return len(a) > 0
+}
+
+// prescanUpdates checks the update section (https://tools.ietf.org/html/rfc2136#section-3.4.1).
+func prescanUpdates(zone dns.Question, updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone.Name, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		if !isTransferable(newIndexableName(hdr.Name)) {
+			// named parameters are not allowed
+			return dns.RcodeRefused
+		}
+
+		switch hdr.Class {
+		case zone.Qclass:
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			switch hdr.Rrtype {
+			case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdates applies the update section (https://tools.ietf.org/html/rfc2136#section-3.4.2),
+// it reports whether anything is changed, and whether the SOA is replaced.
+func (t *txn) applyUpdates(zone dns.Question, origin string, updates []dns.RR) (changed, soaChanged bool, err error) {
+	class := zone.Qclass
+	for _, rr := range updates {
+		hdr := rr.Header()
+		atApex := equalName(hdr.Name, zone.Name)
+
+		switch hdr.Class {
+		case class:
+			switch hdr.Rrtype {
+			case dns.TypeSOA:
+				soa, _ := t.apex(zone.Name, class)
+				next := rr.(*dns.SOA)
+				if !atApex || !serialGreater(next.Serial, soa.Serial) {
+					continue
+				}
+				t.replaceSOA(class, origin, soa, next)
+				changed, soaChanged = true, true
+				continue
+			case dns.TypeCNAME:
+				rrs, others := t.rrset(hdr.Name, class, dns.TypeANY)
+				if others || len(rrs) > 0 && First(rrs, dns.TypeCNAME) == -1 {
+					// CNAME can't coexist with other data
+					continue
+				}
+
+				// replaces the existing one
+				t.remove(hdr.Name, class, func(h typeHandler) bool {
+					_, ok := h.Handler.(Answer)
+					return ok && h.Qtype == dns.TypeCNAME
+				})
+			default:
+				if rrs, _ := t.rrset(hdr.Name, class, dns.TypeCNAME); len(rrs) > 0 {
+					continue
+				}
+			}
+
+			// replaces a duplicate, e.g. for a new TTL
+			t.remove(hdr.Name, class, func(h typeHandler) bool {
+				a, ok := h.Handler.(Answer)
+				return ok && equalRecord(a.RR, rr)
+			})
+			if err = t.tryHandle(hdr.Name, class, newTypeHandler(origin, rr, nil)); err != nil {
+				return
+			}
+			changed = true
+
+		case dns.ClassANY:
+			if atApex && (hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeNS) {
+				continue
+			}
+			n := t.remove(hdr.Name, class, func(h typeHandler) bool {
+				if _, ok := h.Handler.(Answer); !ok {
+					return false
+				}
+				if hdr.Rrtype != dns.TypeANY {
+					return h.Qtype == hdr.Rrtype
+				}
+				return !atApex || h.Qtype != dns.TypeSOA && h.Qtype != dns.TypeNS
+			})
+			changed = changed || n > 0
+
+		case dns.ClassNONE:
+			if atApex && hdr.Rrtype == dns.TypeSOA {
+				continue
+			}
+			if atApex && hdr.Rrtype == dns.TypeNS {
+				if rrs, _ := t.rrset(hdr.Name, class, dns.TypeNS); len(rrs) <= 1 {
+					// never deletes the last NS of zone
+					continue
+				}
+			}
+			n := t.remove(hdr.Name, class, func(h typeHandler) bool {
+				a, ok := h.Handler.(Answer)
+				return ok && equalRecord(a.RR, rr)
+			})
+			changed = changed || n > 0
+		}
+	}
+	return
+}
+
+// replaceSOA replaces the SOA of zone with next.
+func (t *txn) replaceSOA(qclass uint16, origin string, soa, next *dns.SOA) {
+	t.remove(soa.Hdr.Name, qclass, func(h typeHandler) bool {
+		a, ok := h.Handler.(Answer)
+		return ok && a.RR == dns.RR(soa)
+	})
+	t.handle(soa.Hdr.Name, qclass, newTypeHandler(origin, next, nil))
+}
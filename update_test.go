@@ -0,0 +1,203 @@
+package dnsrouter
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpdate(t *testing.T) {
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns", "ns 3600 IN A 127.0.0.1", "www 3600 IN A 127.0.0.2")), "example.org.", "stdin")
+
+	update := new(Update)
+	update.ACL, _ = ParseACL("127.0.0.1")
+	router.OpcodeHandler = map[int]Handler{dns.OpcodeUpdate: update}
+	handler := Classic(context.Background(), router)
+
+	var changes []string
+	router.OnZoneChange = func(origin string) {
+		changes = append(changes, origin)
+	}
+
+	localAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	send := func(addr net.Addr, m *dns.Msg) int {
+		conn := &testConn{remoteAddr: addr}
+		handler.ServeDNS(conn, m)
+		if len(conn.msgs) != 1 || conn.msgs[0].Opcode != dns.OpcodeUpdate {
+			t.Fatalf("unexpected response: %v", conn.msgs)
+		}
+		return conn.msgs[0].Rcode
+	}
+	newRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	newUpdate := func(zone string) *dns.Msg {
+		return new(dns.Msg).SetUpdate(zone)
+	}
+	serial := func() uint32 {
+		return router.zoneSOA("example.org.", dns.ClassINET).Serial
+	}
+	lookup := func(name string, qtype uint16) []dns.RR {
+		resp := NewResponseWriter()
+		router.Lookup(name, dns.ClassINET).Search(qtype).ServeDNS(resp, NewRequest(name, qtype))
+		return resp.Msg().Answer
+	}
+
+	tests := []struct {
+		addr  net.Addr
+		m     *dns.Msg
+		rcode int
+	}{
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, newUpdate("example.org."), dns.RcodeRefused},
+		{localAddr, newUpdate("example.com."), dns.RcodeNotAuth},
+		{localAddr, newUpdate("www.example.org."), dns.RcodeNotAuth},
+	}
+
+	m := newUpdate("example.org.")
+	m.Insert([]dns.RR{newRR("www.example.com. 3600 IN A 127.0.0.1")})
+	tests = append(tests, struct {
+		addr  net.Addr
+		m     *dns.Msg
+		rcode int
+	}{localAddr, m, dns.RcodeNotZone})
+
+	prereqs := []struct {
+		set   func(m *dns.Msg)
+		rcode int
+	}{
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{newRR("nx.example.org. A")}) }, dns.RcodeNameError},
+		{func(m *dns.Msg) { m.NameNotUsed([]dns.RR{newRR("www.example.org. A")}) }, dns.RcodeYXDomain},
+		{func(m *dns.Msg) { m.RRsetUsed([]dns.RR{newRR("www.example.org. AAAA")}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{newRR("www.example.org. A")}) }, dns.RcodeYXRrset},
+		{func(m *dns.Msg) { m.Used([]dns.RR{newRR("www.example.org. 0 A 127.0.0.3")}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.Used([]dns.RR{newRR("www.example.org. 3600 A 127.0.0.2")}) }, dns.RcodeFormatError},
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{newRR("www.example.com. A")}) }, dns.RcodeNotZone},
+	}
+	for _, prereq := range prereqs {
+		m := newUpdate("example.org.")
+		prereq.set(m)
+		m.Insert([]dns.RR{newRR("host.example.org. 3600 IN A 127.0.0.4")})
+		tests = append(tests, struct {
+			addr  net.Addr
+			m     *dns.Msg
+			rcode int
+		}{localAddr, m, prereq.rcode})
+	}
+
+	m = newUpdate("example.org.")
+	m.Insert([]dns.RR{newRR(":host.example.org. 3600 IN A 127.0.0.4")})
+	tests = append(tests, struct {
+		addr  net.Addr
+		m     *dns.Msg
+		rcode int
+	}{localAddr, m, dns.RcodeRefused})
+
+	for i, test := range tests {
+		if rcode := send(test.addr, test.m); rcode != test.rcode {
+			t.Errorf("%d: expected rcode %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+		}
+	}
+	if serial() != 1 || len(lookup("host.example.org.", dns.TypeA)) != 0 || changes != nil {
+		t.Fatal("zone is changed by a failed update")
+	}
+
+	// inserts with satisfied prerequisites
+	m = newUpdate("example.org.")
+	m.NameUsed([]dns.RR{newRR("www.example.org. A")})
+	m.NameNotUsed([]dns.RR{newRR("host.example.org. A")})
+	m.RRsetUsed([]dns.RR{newRR("www.example.org. A")})
+	m.RRsetNotUsed([]dns.RR{newRR("www.example.org. AAAA")})
+	m.Used([]dns.RR{newRR("www.example.org. 0 A 127.0.0.2")})
+	m.Insert([]dns.RR{
+		newRR("host.example.org. 300 IN A 127.0.0.4"),
+		newRR("host.example.org. 300 IN A 127.0.0.5"),
+		newRR("www.example.org. 300 IN CNAME host.example.org."),
+	})
+	if rcode := send(localAddr, m); rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected rcode: %s", dns.RcodeToString[rcode])
+	}
+	if serial() != 2 || len(lookup("host.example.org.", dns.TypeA)) != 2 || len(lookup("www.example.org.", dns.TypeCNAME)) != 0 {
+		t.Fatal("failed to update")
+	}
+	if strings.Join(changes, " ") != "example.org." {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	if rrs, ok := router.ixfr("example.org.", dns.ClassINET, 1); !ok || len(rrs) != 4 {
+		t.Fatalf("unexpected journal: %v", rrs)
+	}
+
+	// updates TTL
+	m = newUpdate("example.org.")
+	m.Insert([]dns.RR{newRR("host.example.org. 60 IN A 127.0.0.4")})
+	send(localAddr, m)
+	if rrs := lookup("host.example.org.", dns.TypeA); len(rrs) != 2 || rrs[0].Header().Ttl+rrs[1].Header().Ttl != 360 || serial() != 3 {
+		t.Fatalf("failed to update TTL: %v", rrs)
+	}
+
+	// deletes
+	m = newUpdate("example.org.")
+	m.Remove([]dns.RR{newRR("host.example.org. 60 IN A 127.0.0.4")})
+	send(localAddr, m)
+	if rrs := lookup("host.example.org.", dns.TypeA); len(rrs) != 1 || serial() != 4 {
+		t.Fatalf("failed to delete a record: %v", rrs)
+	}
+
+	m = newUpdate("example.org.")
+	m.RemoveRRset([]dns.RR{newRR("www.example.org. A")})
+	m.RemoveName([]dns.RR{newRR("host.example.org. A")})
+	send(localAddr, m)
+	if len(lookup("www.example.org.", dns.TypeA)) != 0 || len(lookup("host.example.org.", dns.TypeA)) != 0 || serial() != 5 {
+		t.Fatal("failed to delete RRsets")
+	}
+
+	// the SOA and the last NS are kept, so nothing is changed
+	m = newUpdate("example.org.")
+	m.RemoveName([]dns.RR{newRR("example.org. A")})
+	m.RemoveRRset([]dns.RR{newRR("example.org. SOA")})
+	m.Remove([]dns.RR{newRR("example.org. 3600 IN NS ns.example.org.")})
+	send(localAddr, m)
+	if len(lookup("example.org.", dns.TypeNS)) != 1 || serial() != 5 {
+		t.Fatal("deleted the SOA or NS")
+	}
+
+	// a CNAME is ignored if other data exists
+	m = newUpdate("example.org.")
+	m.Insert([]dns.RR{newRR("ns.example.org. 300 IN CNAME host.example.org.")})
+	send(localAddr, m)
+	if len(lookup("ns.example.org.", dns.TypeCNAME)) != 0 || serial() != 5 {
+		t.Fatal("added a CNAME along with other data")
+	}
+
+	// a greater SOA replaces the current one
+	m = newUpdate("example.org.")
+	m.Insert([]dns.RR{
+		newRR("example.org. 3600 IN SOA ns.example.org. admin.example.org. 100 7200 3600 604800 3600"),
+		newRR("www.example.org. 300 IN A 127.0.0.2"),
+	})
+	send(localAddr, m)
+	if serial() != 100 || len(lookup("www.example.org.", dns.TypeA)) != 1 {
+		t.Fatal("failed to update SOA")
+	}
+
+	m = newUpdate("example.org.")
+	m.Insert([]dns.RR{newRR("example.org. 3600 IN SOA ns.example.org. admin.example.org. 99 7200 3600 604800 3600")})
+	send(localAddr, m)
+	if serial() != 100 {
+		t.Fatal("updated a smaller SOA")
+	}
+
+	// updated zone is transferred as loaded
+	rrs := router.zone("example.org.", dns.ClassINET)
+	if len(rrs) != 4 {
+		t.Fatalf("unexpected zone: %v", rrs)
+	}
+}
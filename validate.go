@@ -0,0 +1,276 @@
+package dnsrouter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ProblemKind is the kind of a Problem found by Validate.
+type ProblemKind int
+
+// Kinds of problems.
+const (
+	// MissingSOA means no SOA at the apex.
+	MissingSOA ProblemKind = iota + 1
+
+	// DuplicateSOA means more than one SOA at the apex.
+	DuplicateSOA
+
+	// MissingNS means no NS at the apex.
+	MissingNS
+
+	// CNAMEAndOtherData means a CNAME coexists with other data (https://tools.ietf.org/html/rfc2181#section-10.1).
+	CNAMEAndOtherData
+
+	// OutOfZone means a record loaded with the origin is not at or below the apex.
+	OutOfZone
+
+	// MissingGlue means no address records of an in-bailiwick name server.
+	MissingGlue
+
+	// DNAMEWithDescendants means a DNAME has descendants (https://tools.ietf.org/html/rfc6672#section-2.4).
+	DNAMEWithDescendants
+
+	// WildcardConflict means a wildcard which panics or loops while expanding,
+	// i.e. a CNAME coexisting with other data, or a CNAME targeting a name
+	// covered by the wildcard itself.
+	WildcardConflict
+
+	// ShadowedName means a named-parameter pattern is registered upon an
+	// existing name, e.g. ":x.example.org" upon "*.example.org", of which the
+	// records are served along with the name's own.
+	ShadowedName
+)
+
+var problemKindToString = map[ProblemKind]string{
+	MissingSOA:           "missing SOA",
+	DuplicateSOA:         "duplicate SOA",
+	MissingNS:            "missing NS",
+	CNAMEAndOtherData:    "CNAME and other data",
+	OutOfZone:            "out of zone",
+	MissingGlue:          "missing glue",
+	DNAMEWithDescendants: "DNAME with descendants",
+	WildcardConflict:     "wildcard conflict",
+	ShadowedName:         "shadowed name",
+}
+
+func (k ProblemKind) String() string {
+	if s, ok := problemKindToString[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// Problem is an inconsistency of a zone found by Validate.
+type Problem struct {
+	Kind   ProblemKind
+	Origin string
+
+	// Name is the owner name having the problem.
+	Name string
+
+	// Detail describes the problem, e.g. the conflicting name.
+	Detail string
+}
+
+func (p Problem) String() string {
+	s := p.Origin + ": " + p.Name + ": " + p.Kind.String()
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	return s
+}
+
+// Validate checks every zone of the class, i.e. origins loaded by HandleZone or
+// its variants, and names owning a SOA, see ValidateZone for details.
+// Problems are ordered by origins in canonical order.
+func (r *Router) Validate(qclass uint16) []Problem {
+	root := r.loadTrees()[qclass]
+	if root == nil {
+		return nil
+	}
+
+	var origins []string
+	seen := make(map[string]bool)
+	root.walkName(root.name, func(name string, n *node) {
+		if n.data == nil {
+			return
+		}
+		for _, h := range n.data.handler {
+			origin := h.Origin
+			if origin == "" {
+				if h.Qtype != dns.TypeSOA {
+					continue
+				}
+				origin = domainName(name)
+			}
+			origin = strings.ToLower(dns.Fqdn(origin))
+			if !seen[origin] {
+				seen[origin] = true
+				origins = append(origins, origin)
+			}
+		}
+	})
+	sort.Slice(origins, func(i, j int) bool {
+		return canonicalLess(newIndexableName(origins[i]), newIndexableName(origins[j]))
+	})
+
+	var problems []Problem
+	for _, origin := range origins {
+		problems = append(problems, validateZone(root, origin)...)
+	}
+	return problems
+}
+
+// ValidateZone checks the zone whose apex is the origin for problems which are
+// accepted by HandleZone but make the zone misbehave in lookups. Records of
+// the zone are those of WalkZone, besides records loaded with the origin but
+// out of the zone. Problems of the apex are reported first, then out of zone
+// records, then others ordered by names in canonical order.
+func (r *Router) ValidateZone(origin string, qclass uint16) []Problem {
+	root := r.loadTrees()[qclass]
+	if root == nil {
+		root = new(node)
+	}
+	return validateZone(root, strings.ToLower(dns.Fqdn(origin)))
+}
+
+func validateZone(root *node, origin string) []Problem {
+	var problems []Problem
+	report := func(kind ProblemKind, name, detail string) {
+		problems = append(problems, Problem{Kind: kind, Origin: origin, Name: name, Detail: detail})
+	}
+
+	var (
+		apexName = newIndexableName(origin)
+		routes   []Route
+	)
+	for _, v := range zoneNodes(root, origin) {
+		covered := v.covered
+		route := newRoute(v.name, v.node.data.handler, func(h typeHandler) bool {
+			return inZone(h, origin, covered)
+		})
+		if len(route.Handlers) == 0 {
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	var apex Route
+	if len(routes) > 0 && equalName(routes[0].Name, origin) {
+		apex = routes[0]
+	}
+	switch n := countType(apex.Handlers, dns.TypeSOA); {
+	case n == 0:
+		report(MissingSOA, origin, "")
+	case n > 1:
+		report(DuplicateSOA, origin, fmt.Sprintf("%d SOA records", n))
+	}
+	if countType(apex.Handlers, dns.TypeNS) == 0 {
+		report(MissingNS, origin, "")
+	}
+
+	// out of zone records are not visited by zoneNodes
+	var outOfZone []string
+	root.walkName(root.name, func(fullName string, n *node) {
+		if n.data == nil {
+			return
+		}
+		if fullName == apexName || strings.HasPrefix(fullName, apexName+".") {
+			return
+		}
+		for _, h := range n.data.handler {
+			if h.Origin != "" && equalName(h.Origin, origin) {
+				outOfZone = append(outOfZone, fullName)
+				return
+			}
+		}
+	})
+	sort.Slice(outOfZone, func(i, j int) bool {
+		return canonicalLess(outOfZone[i], outOfZone[j])
+	})
+	for _, name := range outOfZone {
+		report(OutOfZone, domainName(name), "")
+	}
+
+	for i, route := range routes {
+		wildcardConflict := false
+		if countType(route.Handlers, dns.TypeCNAME) > 0 {
+			for _, h := range route.Handlers {
+				switch h.Qtype {
+				case dns.TypeCNAME, dns.TypeRRSIG, dns.TypeNSEC:
+					continue
+				}
+				if route.Wildcard {
+					wildcardConflict = true
+					report(WildcardConflict, route.Name, "CNAME and "+dns.TypeToString[h.Qtype])
+				} else {
+					report(CNAMEAndOtherData, route.Name, dns.TypeToString[h.Qtype])
+				}
+				break
+			}
+		}
+
+		if route.Wildcard && !wildcardConflict {
+			for _, rr := range answerRoutes(route, dns.TypeCNAME) {
+				target := rr.(*dns.CNAME).Target
+				v := root.getValue(newIndexableName(target))
+				if v.node != nil && v.node == root.findRoute(newIndexableName(route.Name)) {
+					report(WildcardConflict, route.Name, "CNAME to "+target+" covered by itself")
+					break
+				}
+			}
+		}
+
+		for _, rr := range answerRoutes(route, dns.TypeNS) {
+			target := rr.(*dns.NS).Ns
+			if !dns.IsSubDomain(origin, target) {
+				continue
+			}
+			n := root.findRoute(newIndexableName(target))
+			if n == nil || n.data == nil || n.data.handler.Search(dns.TypeA) == nil && n.data.handler.Search(dns.TypeAAAA) == nil {
+				report(MissingGlue, route.Name, target)
+			}
+		}
+
+		if countType(route.Handlers, dns.TypeDNAME) > 0 && i+1 < len(routes) &&
+			dns.IsSubDomain(route.Name, routes[i+1].Name) {
+			report(DNAMEWithDescendants, route.Name, routes[i+1].Name)
+		}
+
+		// the tree merges a pattern into the matching wildcard node
+		for _, h := range route.Handlers {
+			if a, ok := h.Handler.(Answer); ok && !equalName(a.Header().Name, route.Name) {
+				report(ShadowedName, route.Name, "by "+a.Header().Name)
+				break
+			}
+		}
+	}
+
+	return problems
+}
+
+// countType returns the number of handlers of the qtype.
+func countType(l []RouteHandler, qtype uint16) int {
+	var n int
+	for _, h := range l {
+		if h.Qtype == qtype {
+			n++
+		}
+	}
+	return n
+}
+
+// answerRoutes returns records of Answer handlers of the qtype.
+func answerRoutes(route Route, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, h := range route.Handlers {
+		if a, ok := h.Handler.(Answer); ok && h.Qtype == qtype {
+			rrs = append(rrs, a.RR)
+		}
+	}
+	return rrs
+}
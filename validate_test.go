@@ -0,0 +1,65 @@
+package dnsrouter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRouterValidate(t *testing.T) {
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 127.0.0.1",
+		"www 3600 IN CNAME ns",
+		"*.w 3600 IN CNAME ns",
+		"sub 3600 IN NS ns.sub",
+		"ns.sub 3600 IN AAAA ::1",
+	)), "example.org.", "stdin")
+	router.HandleZone(strings.NewReader(newTestZone("bad.org.", 1,
+		"@ 3600 IN SOA ns2 admin 2 7200 3600 604800 3600",
+		"www 3600 IN CNAME a",
+		"www 3600 IN A 127.0.0.1",
+		"x.example.com. 3600 IN A 127.0.0.2",
+		"sub 3600 IN NS ns.sub",
+		"d 3600 IN DNAME example.org.",
+		"x.d 3600 IN A 127.0.0.3",
+		"*.w 3600 IN CNAME a.w",
+		"*.v 3600 IN CNAME a",
+		"*.v 3600 IN A 127.0.0.4",
+		"*.q 3600 IN A 127.0.0.5",
+	)), "bad.org.", "stdin")
+	router.Handle(":p.q.bad.org. 3600 IN A 127.0.0.6", nil)
+
+	if problems := router.ValidateZone("Example.Org", dns.ClassINET); problems != nil {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	var l []string
+	for _, p := range router.Validate(dns.ClassINET) {
+		l = append(l, p.String())
+	}
+	expected := []string{
+		"bad.org.: bad.org.: duplicate SOA: 2 SOA records",
+		"bad.org.: bad.org.: missing NS",
+		"bad.org.: x.example.com.: out of zone",
+		"bad.org.: d.bad.org.: DNAME with descendants: x.d.bad.org.",
+		"bad.org.: *.q.bad.org.: shadowed name: by :p.q.bad.org.",
+		"bad.org.: sub.bad.org.: missing glue: ns.sub.bad.org.",
+		"bad.org.: *.v.bad.org.: wildcard conflict: CNAME and A",
+		"bad.org.: *.w.bad.org.: wildcard conflict: CNAME to a.w.bad.org. covered by itself",
+		"bad.org.: www.bad.org.: CNAME and other data: A",
+	}
+	if strings.Join(l, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected problems:\n%s", strings.Join(l, "\n"))
+	}
+
+	l = nil
+	for _, p := range router.ValidateZone("example.com.", dns.ClassINET) {
+		l = append(l, p.Kind.String())
+	}
+	if s := strings.Join(l, ","); s != "missing SOA,missing NS" {
+		t.Errorf("unexpected problems: %s", s)
+	}
+}
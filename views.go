@@ -0,0 +1,102 @@
+package dnsrouter
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// View is a Router serving a part of clients, e.g. internal clients of split
+// horizon DNS, which are matched by source addresses or TSIG keys.
+type View struct {
+	Name string
+
+	// ACL and Keys match clients served by the view, see ACL.
+	ACL  ACL
+	Keys []string
+
+	// Router serves requests of the view with its own trees and Middleware.
+	Router *Router
+
+	// Fallthrough makes the view an overlay upon the default Router of Views,
+	// i.e. a name neither registered nor within any zone of the view is served
+	// by the default Router.
+	Fallthrough bool
+}
+
+type viewContextKeyType int
+
+// ViewContextKey is used to get the name of the View serving the request from
+// Request context, which is empty if served by the default Router of Views.
+const ViewContextKey viewContextKeyType = 4
+
+// Views is a Handler dispatching requests among views. Since ClassContextKey
+// is set by the Router of the selected view, middleware schemes work per view.
+// As for views matched by TSIG keys, Views should be wrapped by Tsig.Handler
+// instead of Tsig being a middleware of routers, for the key is verified before
+// selecting a view, e.g.
+//
+//	tsig := &Tsig{Keys: keys}
+//	views := &Views{
+//		Views: []View{
+//			{Name: "internal", ACL: internalACL, Keys: []string{"internal."}, Router: internal},
+//		},
+//		Default: external,
+//	}
+//	tsig.Configure(server)
+//	server.Handler = Classic(ctx, tsig.Handler(views))
+type Views struct {
+	// Views are matched in order, the first one matching the client serves the request.
+	Views []View
+
+	// Default serves requests not matched by any view, if it is nil then such
+	// requests are responded with REFUSED.
+	Default *Router
+}
+
+// Making sure the Views conforms with the Handler interface.
+var _ Handler = new(Views)
+
+// Select returns the first view matching the client, or nil if none.
+func (v *Views) Select(w ResponseWriter, req *Request) *View {
+	addr := remoteAddr(w)
+	for i := range v.Views {
+		view := &v.Views[i]
+		if view.ACL.ContainsAddr(addr) || tsigAllowed(req, view.Keys) {
+			return view
+		}
+	}
+	return nil
+}
+
+// ServeDNS implements Handler interface.
+func (v *Views) ServeDNS(w ResponseWriter, req *Request) {
+	var (
+		name   string
+		router = v.Default
+	)
+	if view := v.Select(w, req); view != nil && (!view.Fallthrough || view.covers(req)) {
+		name, router = view.Name, view.Router
+	}
+	if router == nil {
+		w.Msg().Rcode = dns.RcodeRefused
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), ViewContextKey, name)
+	router.ServeDNS(w, req.WithContext(ctx))
+}
+
+// covers reports whether the question name is registered or within a zone of the view.
+func (view *View) covers(req *Request) bool {
+	if view.Router == nil || len(req.Question) == 0 {
+		return false
+	}
+
+	class := view.Router.Lookup(req.Question[0].Name, req.Question[0].Qclass)
+	if zone, _ := class.Zone(); zone != nil {
+		return true
+	}
+	c, _ := class.(basicClass)
+	return c.handler != nil
+}
@@ -0,0 +1,107 @@
+package dnsrouter
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestViews(t *testing.T) {
+	viewName := func(w ResponseWriter, req *Request) {
+		name, _ := req.Context().Value(ViewContextKey).(string)
+		w.Msg().Answer = append(w.Msg().Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{name},
+		})
+	}
+
+	external := New()
+	external.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 192.0.2.1",
+		"www 3600 IN A 192.0.2.2",
+	)), "example.org.", "stdin")
+	external.HandleFunc("view.example.org. 0 IN TXT", viewName)
+
+	internal := New()
+	internal.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 10.0.0.1",
+		"www 3600 IN A 10.0.0.2",
+	)), "example.org.", "stdin")
+	internal.HandleFunc("view.example.org. 0 IN TXT", viewName)
+
+	lab := New()
+	lab.HandleZone(strings.NewReader(newTestZone("lab.example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 10.1.0.1",
+		"www 3600 IN A 10.1.0.2",
+	)), "lab.example.org.", "stdin")
+
+	acl, err := ParseACL("10.0.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labACL, err := ParseACL("10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	views := &Views{
+		Views: []View{
+			{Name: "internal", ACL: acl, Keys: []string{"internal."}, Router: internal},
+			{Name: "lab", ACL: labACL, Router: lab, Fallthrough: true},
+		},
+		Default: external,
+	}
+
+	query := func(ctx context.Context, ip net.IP, qname string, qtype uint16) *dns.Msg {
+		conn := &testConn{remoteAddr: &net.UDPAddr{IP: ip, Port: 5353}}
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+		Classic(ctx, views).ServeDNS(conn, req)
+		return conn.msgs[0]
+	}
+	keyed := context.WithValue(context.Background(), TsigContextKey, "internal.")
+
+	tests := []struct {
+		ctx    context.Context
+		ip     net.IP
+		qname  string
+		qtype  uint16
+		answer string
+	}{
+		{context.Background(), net.IPv4(192, 0, 2, 100), "www.example.org.", dns.TypeA, "192.0.2.2"},
+		{context.Background(), net.IPv4(192, 0, 2, 100), "view.example.org.", dns.TypeTXT, "\"\""},
+		{context.Background(), net.IPv4(10, 0, 1, 1), "www.example.org.", dns.TypeA, "10.0.0.2"},
+		{context.Background(), net.IPv4(10, 0, 1, 1), "view.example.org.", dns.TypeTXT, "\"internal\""},
+		{keyed, net.IPv4(192, 0, 2, 100), "www.example.org.", dns.TypeA, "10.0.0.2"},
+		{context.Background(), net.IPv4(10, 1, 1, 1), "www.lab.example.org.", dns.TypeA, "10.1.0.2"},
+		{context.Background(), net.IPv4(10, 1, 1, 1), "nx.lab.example.org.", dns.TypeA, ""},
+		{context.Background(), net.IPv4(10, 1, 1, 1), "www.example.org.", dns.TypeA, "192.0.2.2"},
+		{context.Background(), net.IPv4(10, 1, 1, 1), "view.example.org.", dns.TypeTXT, "\"\""},
+	}
+	for _, test := range tests {
+		m := query(test.ctx, test.ip, test.qname, test.qtype)
+		var answer string
+		if len(m.Answer) > 0 {
+			answer = strings.TrimPrefix(m.Answer[0].String(), m.Answer[0].Header().String())
+		}
+		if answer != test.answer {
+			t.Errorf("%s %s: expected %q, got %v", test.ip, test.qname, test.answer, m)
+		}
+	}
+
+	m := query(context.Background(), net.IPv4(10, 1, 1, 1), "nx.lab.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || len(m.Ns) == 0 {
+		t.Errorf("expected NXDOMAIN of the lab view, got %v", m)
+	}
+
+	views.Default = nil
+	m = query(context.Background(), net.IPv4(192, 0, 2, 100), "www.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED, got %v", m)
+	}
+}
@@ -0,0 +1,112 @@
+package dnsrouter
+
+import (
+	"sort"
+	"strings"
+)
+
+// Route is a name registered in a Router with its handlers.
+type Route struct {
+	// Name is the registered name in lower case, e.g. "www.example.org.",
+	// "*.example.org." or ":user.example.org.".
+	Name string
+
+	// Wildcard reports whether the name is a DNS wildcard (https://tools.ietf.org/html/rfc4592).
+	Wildcard bool
+
+	// Parameterized reports whether the name consists of named parameters or
+	// catch-all parameters.
+	Parameterized bool
+
+	// Handlers are ordered by qtype, then by the covered type of RRSIG.
+	Handlers []RouteHandler
+}
+
+// RouteHandler is a handler registered for a name.
+type RouteHandler struct {
+	// Origin is the zone loaded by HandleZone or its variants, or empty if
+	// registered by Handle.
+	Origin string
+
+	Qtype uint16
+
+	// TypeCovered is the type covered by a RRSIG, or 0 for other types.
+	TypeCovered uint16
+
+	// Handler is an Answer if the record is served statically.
+	Handler Handler
+}
+
+// Walk calls fn for each name registered in the class in canonical order
+// (https://tools.ietf.org/html/rfc4034#section-6.1), upon a snapshot of the
+// Router, so fn could change the Router without affecting the walk.
+// If fn returns an error, the walk stops and returns the error.
+func (r *Router) Walk(qclass uint16, fn func(Route) error) error {
+	root := r.loadTrees()[qclass]
+	if root == nil {
+		return nil
+	}
+
+	var nodes []zoneNode
+	root.walkName(root.name, func(name string, n *node) {
+		if n.data != nil && len(n.data.handler) > 0 {
+			nodes = append(nodes, zoneNode{name: name, node: n})
+		}
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return canonicalLess(nodes[i].name, nodes[j].name)
+	})
+
+	for _, v := range nodes {
+		if err := fn(newRoute(v.name, v.node.data.handler, nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkZone is like Walk, but only visits names of the zone whose apex is the origin,
+// with handlers belonging to the zone, i.e. loaded with the origin, or registered
+// by Handle and not covered by any child zone. It returns ErrNoZone if no such zone.
+func (r *Router) WalkZone(origin string, qclass uint16, fn func(Route) error) error {
+	root := r.loadTrees()[qclass]
+	if root == nil || nodeSOA(root, origin) == nil {
+		return ErrNoZone
+	}
+
+	for _, v := range zoneNodes(root, origin) {
+		covered := v.covered
+		route := newRoute(v.name, v.node.data.handler, func(h typeHandler) bool {
+			return inZone(h, origin, covered)
+		})
+		if len(route.Handlers) == 0 {
+			continue
+		}
+		if err := fn(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRoute returns a Route of an indexable name with handlers matched by f, or all if f is nil.
+func newRoute(name string, l classHandler, f func(typeHandler) bool) Route {
+	route := Route{
+		Name:          domainName(name),
+		Parameterized: !isTransferable(name),
+	}
+	route.Wildcard = strings.HasPrefix(route.Name, "*.")
+	for _, h := range l {
+		if f == nil || f(h) {
+			route.Handlers = append(route.Handlers, RouteHandler(h))
+		}
+	}
+	return route
+}
+
+// domainName converts an indexable name back to the domain name in lower case.
+func domainName(name string) string {
+	b := []byte(name)
+	reverseLabels(b)
+	return string(b)
+}
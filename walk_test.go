@@ -0,0 +1,95 @@
+package dnsrouter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRouterWalk(t *testing.T) {
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 127.0.0.1",
+		"www 3600 IN A 127.0.0.2",
+		"www 3600 IN AAAA ::1",
+		"*.w 3600 IN TXT wildcard",
+	)), "example.org.", "stdin")
+	router.HandleZone(strings.NewReader(newTestZone("child.example.org.", 1,
+		"www 3600 IN A 127.0.0.3",
+	)), "child.example.org.", "stdin")
+	router.Handle("Mail.Example.Org. 3600 IN A 127.0.0.4", nil)
+	router.Handle(":user.dyn.example.org. 3600 IN A 127.0.0.5", nil)
+	router.Handle("www.example.com. 3600 IN A 127.0.0.6", nil)
+
+	format := func(route Route) string {
+		s := route.Name
+		if route.Wildcard {
+			s += " wildcard"
+		}
+		if route.Parameterized {
+			s += " parameterized"
+		}
+		for _, h := range route.Handlers {
+			s += fmt.Sprintf(" %s/%s", dns.TypeToString[h.Qtype], h.Origin)
+		}
+		return s
+	}
+
+	var l []string
+	if err := router.Walk(dns.ClassINET, func(route Route) error {
+		l = append(l, format(route))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"www.example.com. A/",
+		"example.org. NS/example.org. SOA/example.org.",
+		"child.example.org. SOA/child.example.org.",
+		"www.child.example.org. A/child.example.org.",
+		":user.dyn.example.org. parameterized A/",
+		"mail.example.org. A/",
+		"ns.example.org. A/example.org.",
+		"*.w.example.org. wildcard TXT/example.org.",
+		"www.example.org. A/example.org. AAAA/example.org.",
+	}
+	if strings.Join(l, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected routes:\n%s", strings.Join(l, "\n"))
+	}
+
+	l = nil
+	if err := router.WalkZone("Example.Org", dns.ClassINET, func(route Route) error {
+		l = append(l, format(route))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"example.org. NS/example.org. SOA/example.org.",
+		":user.dyn.example.org. parameterized A/",
+		"mail.example.org. A/",
+		"ns.example.org. A/example.org.",
+		"*.w.example.org. wildcard TXT/example.org.",
+		"www.example.org. A/example.org. AAAA/example.org.",
+	}
+	if strings.Join(l, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected routes:\n%s", strings.Join(l, "\n"))
+	}
+
+	if err := router.WalkZone("example.com.", dns.ClassINET, nil); err != ErrNoZone {
+		t.Errorf("expected ErrNoZone, got %v", err)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	if err := router.Walk(dns.ClassINET, func(route Route) error {
+		n++
+		return stop
+	}); err != stop || n != 1 {
+		t.Errorf("expected stopping at the first route, got %v after %d routes", err, n)
+	}
+}
@@ -0,0 +1,215 @@
+package dnsrouter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// WatchEvent reports a reload of a watched zone file.
+type WatchEvent struct {
+	Origin   string
+	Filename string
+
+	// Diff is the changes made by the reload, it is nil if Err is not nil.
+	Diff *ZoneDiff
+
+	// Err is the error occurred while reading or reloading the file, includes
+	// ErrSerialNotIncreased if the changed file is skipped.
+	Err error
+}
+
+// A Watcher polls zone files and reloads a zone into the Router by ReloadZone
+// once its file is changed. A file is considered as changed if the modification
+// time or size differs, and then the content hash differs. A file failed to read
+// or load is retried with an exponential backoff, while a file skipped for an
+// unchanged SOA serial is not retried until it is changed again.
+type Watcher struct {
+	// Router to reload zones into.
+	Router *Router
+
+	// Interval between polls, it must be positive.
+	Interval time.Duration
+
+	// MaxBackoff limits the delay of retrying a failed file, if it is zero then
+	// defaults to 64 times of Interval.
+	MaxBackoff time.Duration
+
+	// OnEvent is called after each reload if it is not nil.
+	OnEvent func(WatchEvent)
+
+	// Events receives each reload if it is not nil. Sending blocks the polling
+	// until Stop is called, so the channel should be drained or buffered.
+	Events chan<- WatchEvent
+
+	mu    sync.Mutex
+	zones []*watchedZone
+	stop  chan struct{}
+	done  chan struct{}
+
+	polling sync.Mutex // serializes polls
+}
+
+type watchedZone struct {
+	origin   string
+	filename string
+	modTime  time.Time
+	size     int64
+	hash     [sha256.Size]byte
+	failures uint
+	retryAt  time.Time
+}
+
+// NewWatcher returns a Watcher polling at the interval.
+func NewWatcher(r *Router, interval time.Duration) *Watcher {
+	return &Watcher{Router: r, Interval: interval}
+}
+
+// Add watches a zone file, which is loaded at the next poll.
+func (w *Watcher) Add(origin, filename string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.zones = append(w.zones, &watchedZone{origin: origin, filename: filename})
+}
+
+// Start polls all zone files immediately and then periodically in a new goroutine,
+// until Stop is called.
+func (w *Watcher) Start() {
+	w.mu.Lock()
+	if w.stop != nil {
+		w.mu.Unlock()
+		panic("watcher already started")
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	w.stop, w.done = stop, done
+	w.mu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+
+		for {
+			w.poll(stop)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling and waits for the polling goroutine to exit.
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Poll checks all zone files once and reloads the changed ones.
+func (w *Watcher) Poll() {
+	w.poll(nil)
+}
+
+// poll is like Poll, but gives up on stop.
+func (w *Watcher) poll(stop <-chan struct{}) {
+	w.mu.Lock()
+	zones := w.zones
+	w.mu.Unlock()
+
+	w.polling.Lock()
+	defer w.polling.Unlock()
+
+	now := time.Now()
+	for _, z := range zones {
+		if now.Before(z.retryAt) {
+			continue
+		}
+		if ev, ok := w.check(z); ok {
+			if ev.Err != nil && ev.Err != ErrSerialNotIncreased {
+				z.failures++
+				z.retryAt = now.Add(w.backoff(z.failures))
+			} else {
+				z.failures = 0
+			}
+			if !w.emit(ev, stop) {
+				return
+			}
+		}
+	}
+}
+
+// check reloads the zone if the file is changed, it reports whether a reload is tried.
+func (w *Watcher) check(z *watchedZone) (ev WatchEvent, ok bool) {
+	ev.Origin, ev.Filename = z.origin, z.filename
+
+	fi, err := os.Stat(z.filename)
+	if err != nil {
+		ev.Err = err
+		return ev, true
+	}
+	if z.failures == 0 && fi.ModTime().Equal(z.modTime) && fi.Size() == z.size {
+		return ev, false
+	}
+
+	data, err := ioutil.ReadFile(z.filename)
+	if err != nil {
+		ev.Err = err
+		return ev, true
+	}
+
+	hash := sha256.Sum256(data)
+	if z.failures == 0 && hash == z.hash {
+		z.modTime, z.size = fi.ModTime(), fi.Size()
+		return ev, false
+	}
+
+	ev.Diff, ev.Err = w.Router.ReloadZone(bytes.NewReader(data), z.origin, path.Base(z.filename))
+	if ev.Err == nil || ev.Err == ErrSerialNotIncreased {
+		z.modTime, z.size, z.hash = fi.ModTime(), fi.Size(), hash
+	}
+	return ev, true
+}
+
+func (w *Watcher) backoff(failures uint) time.Duration {
+	max := w.MaxBackoff
+	if max <= 0 {
+		max = 64 * w.Interval
+	}
+
+	d := w.Interval
+	for i := uint(1); i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// emit reports the event, it returns false if stopped while sending to Events.
+func (w *Watcher) emit(ev WatchEvent, stop <-chan struct{}) bool {
+	if w.OnEvent != nil {
+		w.OnEvent(ev)
+	}
+	if w.Events != nil {
+		select {
+		case w.Events <- ev:
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
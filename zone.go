@@ -0,0 +1,354 @@
+package dnsrouter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrSerialNotIncreased is returned by ReloadZone if the zone is skipped
+// since its SOA serial is not greater than the loaded one.
+var ErrSerialNotIncreased = errors.New("dnsrouter: SOA serial not increased")
+
+// ZoneDiff describes the changes made by reloading a zone.
+type ZoneDiff struct {
+	Origin string
+
+	// Serial is the SOA serial of the new zone, or 0 if the zone has no SOA.
+	Serial uint32
+
+	// Added and Removed records, compared by the presentation format, so a
+	// record with a changed TTL is both removed and added.
+	Added, Removed []dns.RR
+}
+
+// Empty reports whether nothing is changed.
+func (d *ZoneDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// ReloadZoneFile reloads a zone file, see ReloadZone for details.
+func (r *Router) ReloadZoneFile(origin, filename string) (*ZoneDiff, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return r.ReloadZone(f, origin, path.Base(filename))
+}
+
+// ReloadZone replaces all records of the origin loaded by HandleZone or its
+// variants with the records from a zone reader, records of other zones or
+// registered by Handle are never touched. The replacement is atomic, i.e. a
+// lookup sees either the old zone or the new one.
+//
+// If both the old and new zone have a SOA at the origin, the new serial must
+// be greater than the old one in the sense of RFC 1982, otherwise nothing is
+// changed and ErrSerialNotIncreased is returned. Like LoadZone, a *ZoneError is
+// returned if the new zone fails to load, and the old zone is kept.
+func (r *Router) ReloadZone(f io.Reader, origin, filename string) (*ZoneDiff, error) {
+	rrs, err := parseZone(f, origin, filename)
+	if err != nil {
+		return nil, err
+	}
+	return r.reloadRecords(rrs, origin, filename)
+}
+
+// reloadRecords is like ReloadZone, but takes records already parsed.
+func (r *Router) reloadRecords(rrs []dns.RR, origin, filename string) (*ZoneDiff, error) {
+	diff := &ZoneDiff{Origin: dns.Fqdn(origin)}
+	if soa := findSOA(rrs, origin); soa != nil {
+		diff.Serial = soa.Serial
+	}
+
+	err := r.update(func(t *txn) error {
+		old := t.zoneRecords(origin)
+		if soa := findSOA(old, origin); soa != nil && diff.Serial != 0 && !serialGreater(diff.Serial, soa.Serial) {
+			return ErrSerialNotIncreased
+		}
+
+		t.removeZone(origin)
+		if err := t.loadRecords(rrs, origin, filename); err != nil {
+			return err
+		}
+		diff.Added, diff.Removed = diffRecords(old, rrs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// patchZone applies changes of an incremental zone transfer upon the zone, which
+// consists of sequences of the old SOA, removed records, the new SOA and added
+// records (https://tools.ietf.org/html/rfc1995#section-4). Either all changes
+// are applied, or nothing is changed if any sequence doesn't fit into the zone.
+func (r *Router) patchZone(rrs []dns.RR, origin string, qclass uint16, filename string) (*ZoneDiff, error) {
+	var allRemoved, allAdded []dns.RR
+	diff := &ZoneDiff{Origin: dns.Fqdn(origin)}
+	err := r.update(func(t *txn) error {
+		for len(rrs) > 0 {
+			from, ok := rrs[0].(*dns.SOA)
+			if !ok {
+				return fmt.Errorf("%s: %s: expected SOA", filename, rrs[0])
+			}
+			if soa := nodeSOA(t.trees[qclass], origin); soa == nil || soa.Serial != from.Serial {
+				return fmt.Errorf("%s: %s: serial mismatch", filename, from)
+			}
+
+			i := 1
+			for i < len(rrs) && rrs[i].Header().Rrtype != dns.TypeSOA {
+				i++
+			}
+			if i == len(rrs) {
+				return fmt.Errorf("%s: %s: missing new SOA", filename, from)
+			}
+			j := i + 1
+			for j < len(rrs) && rrs[j].Header().Rrtype != dns.TypeSOA {
+				j++
+			}
+
+			removed, added := rrs[:i], rrs[i:j]
+			for _, rr := range removed {
+				hdr := rr.Header()
+				n := t.remove(hdr.Name, hdr.Class, func(h typeHandler) bool {
+					a, ok := h.Handler.(Answer)
+					return ok && h.Origin != "" && equalName(h.Origin, origin) && equalRecord(a.RR, rr)
+				})
+				if n == 0 {
+					return fmt.Errorf("%s: %s: no such record", filename, rr)
+				}
+			}
+			if err := t.loadRecords(added, origin, filename); err != nil {
+				return err
+			}
+
+			allRemoved = append(allRemoved, removed...)
+			allAdded = append(allAdded, added...)
+			diff.Serial = added[0].(*dns.SOA).Serial
+			rrs = rrs[j:]
+		}
+
+		diff.Added, diff.Removed = diffRecords(allRemoved, allAdded)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// zoneRecords returns the records loaded into the origin, from every class.
+func (t *txn) zoneRecords(origin string) []dns.RR {
+	var rrs []dns.RR
+	for _, root := range t.trees {
+		root.walk(func(n *node) {
+			if n.data == nil {
+				return
+			}
+			for _, h := range n.data.handler {
+				if h.Origin == "" || !equalName(h.Origin, origin) {
+					continue
+				}
+				if a, ok := h.Handler.(Answer); ok {
+					rrs = append(rrs, a.RR)
+				}
+			}
+		})
+	}
+	return rrs
+}
+
+// equalRecord reports whether two records are equal regardless of TTL and class.
+func equalRecord(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	if ha.Rrtype != hb.Rrtype || !equalName(ha.Name, hb.Name) {
+		return false
+	}
+	return strings.TrimPrefix(a.String(), ha.String()) == strings.TrimPrefix(b.String(), hb.String())
+}
+
+// findSOA returns the SOA owned by the origin.
+func findSOA(rrs []dns.RR, origin string) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok && equalName(soa.Hdr.Name, origin) {
+			return soa
+		}
+	}
+	return nil
+}
+
+// serialGreater reports whether serial a is greater than b, as defined in RFC 1982.
+func serialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// diffRecords returns records in b but not in a, and records in a but not in b.
+func diffRecords(a, b []dns.RR) (added, removed []dns.RR) {
+	m := make(map[string]int, len(a))
+	for _, rr := range a {
+		m[rr.String()]++
+	}
+	for _, rr := range b {
+		s := rr.String()
+		if m[s] > 0 {
+			m[s]--
+		} else {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range a {
+		s := rr.String()
+		if m[s] > 0 {
+			m[s]--
+			removed = append(removed, rr)
+		}
+	}
+	return
+}
+
+// zone returns the records of the zone whose apex is the name in canonical
+// order, led by the SOA, or nil if no such zone.
+// A record belongs to the zone if it is loaded with the origin, or registered
+// by Handle and not covered by any child zone. Only records served by Answer
+// are included, so are named parameters skipped.
+func (r *Router) zone(name string, qclass uint16) []dns.RR {
+	return treeZone(r.loadTrees()[qclass], name)
+}
+
+// treeZone is like Router.zone but upon the tree.
+func treeZone(root *node, name string) []dns.RR {
+	if root == nil {
+		return nil
+	}
+
+	soa := nodeSOA(root, name)
+	if soa == nil {
+		return nil
+	}
+
+	rrs := []dns.RR{soa}
+	for _, v := range zoneNodes(root, name) {
+		if !isTransferable(v.name) {
+			continue
+		}
+		rrs = append(rrs, answerRecords(v.node.data.handler, func(h typeHandler) bool {
+			return inZone(h, name, v.covered)
+		})...)
+	}
+
+	// the SOA is placed first
+	for i := 1; i < len(rrs); i++ {
+		if rrs[i] == dns.RR(soa) {
+			copy(rrs[i:], rrs[i+1:])
+			rrs = rrs[:len(rrs)-1]
+			break
+		}
+	}
+	return rrs
+}
+
+type zoneNode struct {
+	name string
+	node *node
+
+	// covered means the name belongs to a child zone
+	covered bool
+}
+
+// zoneNodes returns nodes of names at or below the apex in canonical order,
+// includes names of child zones.
+func zoneNodes(root *node, name string) []zoneNode {
+	apexName := newIndexableName(name)
+	apex := root.findRoute(apexName)
+	if apex == nil {
+		return nil
+	}
+
+	var (
+		nodes []zoneNode
+		cuts  []string
+	)
+	apex.walkName(apexName, func(fullName string, n *node) {
+		if n.data == nil {
+			return
+		}
+		if fullName != apexName && !strings.HasPrefix(fullName, apexName+".") {
+			return
+		}
+		if fullName != apexName && n.data.handler.Search(dns.TypeSOA) != nil {
+			cuts = append(cuts, fullName)
+		}
+		nodes = append(nodes, zoneNode{name: fullName, node: n})
+	})
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return canonicalLess(nodes[i].name, nodes[j].name)
+	})
+
+	for i, v := range nodes {
+		for _, cut := range cuts {
+			if v.name == cut || strings.HasPrefix(v.name, cut+".") {
+				nodes[i].covered = true
+				break
+			}
+		}
+	}
+	return nodes
+}
+
+// inZone reports whether a handler of a name belongs to the zone of the origin.
+func inZone(h typeHandler, origin string, covered bool) bool {
+	if h.Origin != "" {
+		return equalName(h.Origin, origin)
+	}
+	return !covered
+}
+
+// answerRecords returns records of Answer handlers matched by f, or all if f is nil.
+func answerRecords(l classHandler, f func(typeHandler) bool) []dns.RR {
+	var rrs []dns.RR
+	for _, h := range l {
+		if a, ok := h.Handler.(Answer); ok && (f == nil || f(h)) {
+			rrs = append(rrs, a.RR)
+		}
+	}
+	return rrs
+}
+
+// isTransferable reports whether an indexable name consists of no named parameters.
+func isTransferable(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if label != "" && (label[0] == ':' || label[0] == '*' && label != "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalLess reports whether indexable name a sorts before b in DNSSEC
+// canonical order (https://tools.ietf.org/html/rfc4034#section-6.1),
+// which is the byte order except that the label separator sorts first.
+func canonicalLess(a, b string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == '.' {
+			return true
+		}
+		if b[i] == '.' {
+			return false
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,293 @@
+package dnsrouter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestZone(origin string, serial uint32, records ...string) string {
+	s := fmt.Sprintf("$ORIGIN %s\n@ 3600 IN SOA ns.%s admin.%s %d 7200 3600 604800 3600\n", origin, origin, origin, serial)
+	for _, rr := range records {
+		s += rr + "\n"
+	}
+	return s
+}
+
+func sortedStrings(rrs []dns.RR) []string {
+	var l []string
+	for _, rr := range rrs {
+		l = append(l, rr.String())
+	}
+	sort.Strings(l)
+	return l
+}
+
+func TestRouterReloadZone(t *testing.T) {
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns", "ns 3600 IN A 127.0.0.1", "www 3600 IN A 127.0.0.2")), "example.org.", "stdin")
+	router.HandleZone(strings.NewReader(newTestZone("example.com.", 1,
+		"www 3600 IN A 127.0.0.3")), "example.com.", "stdin")
+	router.Handle("mail.example.org. 3600 IN A 127.0.0.4", nil)
+
+	exists := func(name string, qtype uint16) bool {
+		_, ok := router.Lookup(name, dns.ClassINET).Search(qtype).(RcodeHandler)
+		return !ok
+	}
+
+	if _, err := router.ReloadZone(strings.NewReader(newTestZone("example.org.", 1)), "example.org.", "stdin"); err != ErrSerialNotIncreased {
+		t.Fatalf("expected ErrSerialNotIncreased, got %v", err)
+	}
+	if !exists("www.example.org", dns.TypeA) {
+		t.Fatal("zone is changed by a skipped reload")
+	}
+
+	_, err := router.ReloadZone(strings.NewReader(newTestZone("example.org.", 2, ":x 3600 IN A 127.0.0.1", "*y 3600 IN A 127.0.0.1")), "example.org.", "stdin")
+	if _, ok := err.(*ZoneError); !ok {
+		t.Fatalf("expected *ZoneError, got %v", err)
+	}
+	if !exists("www.example.org", dns.TypeA) {
+		t.Fatal("zone is changed by a failed reload")
+	}
+
+	diff, err := router.ReloadZone(strings.NewReader(newTestZone("example.org.", 2,
+		"@ 3600 IN NS ns", "ns 3600 IN A 127.0.0.1", "ftp 3600 IN A 127.0.0.5")), "example.org", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Origin != "example.org." || diff.Serial != 2 || diff.Empty() {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+
+	added := sortedStrings(diff.Added)
+	removed := sortedStrings(diff.Removed)
+	if len(added) != 2 || !strings.HasPrefix(added[0], "example.org.\t3600\tIN\tSOA\t") || added[1] != "ftp.example.org.\t3600\tIN\tA\t127.0.0.5" {
+		t.Errorf("unexpected added records: %v", added)
+	}
+	if len(removed) != 2 || !strings.HasPrefix(removed[0], "example.org.\t3600\tIN\tSOA\t") || removed[1] != "www.example.org.\t3600\tIN\tA\t127.0.0.2" {
+		t.Errorf("unexpected removed records: %v", removed)
+	}
+
+	for _, name := range []string{"ftp.example.org", "ns.example.org", "mail.example.org", "www.example.com"} {
+		if !exists(name, dns.TypeA) {
+			t.Errorf("%s: A not found", name)
+		}
+	}
+	if exists("www.example.org", dns.TypeA) {
+		t.Error("www.example.org: A is not removed")
+	}
+
+	// the serial arithmetic wraps around
+	diff, err = router.ReloadZone(strings.NewReader(newTestZone("example.com.", 1<<31)), "example.com.", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || len(diff.Removed) != 2 {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+	if _, err := router.ReloadZone(strings.NewReader(newTestZone("example.com.", 1<<31+5)), "example.com.", "stdin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.ReloadZone(strings.NewReader(newTestZone("example.com.", 3)), "example.com.", "stdin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.ReloadZone(strings.NewReader(newTestZone("example.com.", 1<<31+5)), "example.com.", "stdin"); err != ErrSerialNotIncreased {
+		t.Fatalf("expected ErrSerialNotIncreased, got %v", err)
+	}
+
+	if _, err := router.ReloadZoneFile("example.com.", "testdata/nonexistent"); err == nil {
+		t.Fatal("expected an error for a nonexistent file")
+	}
+}
+
+func TestSerialGreater(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 0, true},
+		{0, 1, false},
+		{1, 1, false},
+		{0, 0xffffffff, true},
+		{0x7fffffff, 0, true},
+		{0x80000000, 0, false},
+		{0, 0x80000000, false},
+	}
+	for _, test := range tests {
+		if got := serialGreater(test.a, test.b); got != test.want {
+			t.Errorf("serialGreater(%d, %d): expected %v, got %v", test.a, test.b, test.want, got)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "db.example.org")
+	modTime := time.Now()
+	write := func(s string) {
+		if err := ioutil.WriteFile(filename, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var events []WatchEvent
+	router := New()
+	w := NewWatcher(router, time.Hour)
+	w.OnEvent = func(ev WatchEvent) {
+		events = append(events, ev)
+	}
+	w.Add("example.org.", filename)
+
+	poll := func(n int) {
+		events = nil
+		w.Poll()
+		if len(events) != n {
+			t.Fatalf("expected %d events, got %v", n, events)
+		}
+	}
+
+	poll(1)
+	if !os.IsNotExist(events[0].Err) {
+		t.Fatalf("expected a not exist error, got %v", events[0].Err)
+	}
+	w.zones[0].retryAt = time.Time{}
+
+	write(newTestZone("example.org.", 1, "www 3600 IN A 127.0.0.1"))
+	poll(1)
+	if events[0].Err != nil || len(events[0].Diff.Added) != 2 || events[0].Filename != filename {
+		t.Fatalf("unexpected event: %+v", events[0])
+	}
+	if _, ok := router.Lookup("www.example.org", dns.ClassINET).Search(dns.TypeA).(RcodeHandler); ok {
+		t.Fatal("zone is not loaded")
+	}
+
+	// unchanged
+	poll(0)
+	write(newTestZone("example.org.", 1, "www 3600 IN A 127.0.0.1"))
+	poll(0)
+
+	write(newTestZone("example.org.", 1, "www 3600 IN A 127.0.0.2"))
+	poll(1)
+	if events[0].Err != ErrSerialNotIncreased {
+		t.Fatalf("expected ErrSerialNotIncreased, got %v", events[0].Err)
+	}
+	poll(0)
+
+	write(newTestZone("example.org.", 2, "www 3600 IN A 127.0.0"))
+	poll(1)
+	if _, ok := events[0].Err.(*ZoneError); !ok {
+		t.Fatalf("expected *ZoneError, got %v", events[0].Err)
+	}
+
+	// backoff
+	write(newTestZone("example.org.", 2, "www 3600 IN A 127.0.0.3"))
+	poll(0)
+	if d := w.zones[0].retryAt.Sub(time.Now()); d <= 0 || d > time.Hour {
+		t.Fatalf("unexpected backoff: %v", d)
+	}
+	w.zones[0].retryAt = time.Time{}
+	poll(1)
+	if ev := events[0]; ev.Err != nil || ev.Diff.Serial != 2 || len(ev.Diff.Added) != 2 || len(ev.Diff.Removed) != 2 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if w.zones[0].failures != 0 {
+		t.Fatal("failures are not reset")
+	}
+
+	if w.backoff(1) != time.Hour || w.backoff(3) != 4*time.Hour || w.backoff(100) != 64*time.Hour {
+		t.Fatal("unexpected backoff")
+	}
+}
+
+func TestWatcherStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "db.example.org")
+	if err := ioutil.WriteFile(filename, []byte(newTestZone("example.org.", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan WatchEvent, 1)
+	w := NewWatcher(New(), time.Millisecond)
+	w.Events = events
+	w.Add("example.org.", filename)
+	w.Start()
+	defer w.Stop()
+
+	select {
+	case ev := <-events:
+		if ev.Err != nil || ev.Diff.Serial != 1 {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(newTestZone("example.org.", 2)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Second)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Err != nil || ev.Diff.Serial != 2 {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	// stops while nobody receives events, i.e. one is buffered and the next is blocked
+	for serial := uint32(3); serial <= 4; serial++ {
+		// replaces the file atomically for the polling in the meantime
+		if err := ioutil.WriteFile(filename+".tmp", []byte(newTestZone("example.org.", serial)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(filename+".tmp", modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filename+".tmp", filename); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if soa := w.Router.zoneSOA("example.org.", dns.ClassINET); soa != nil && soa.Serial == serial {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
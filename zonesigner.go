@@ -0,0 +1,182 @@
+package dnsrouter
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrNoZone is returned if a zone is not found in the Router.
+	ErrNoZone = errors.New("dnsrouter: no such zone")
+
+	// ErrNoKeys is returned by ZoneSigner if it has no keys.
+	ErrNoKeys = errors.New("dnsrouter: no signing keys")
+)
+
+// ZoneSigner signs zones loaded in a Router offline (https://tools.ietf.org/html/rfc4035#section-2).
+// The NSEC chain and signatures are inserted into the Router as records of
+// the zone, so that they are served by BasicHandler and NsecHandler as if
+// loaded from a signed zone file.
+type ZoneSigner struct {
+	// Keys to sign zones. A key with SEP flag signs DNSKEY records only,
+	// unless there are no other keys, and vice versa.
+	Keys []SigningKey
+
+	// Inception of signatures, if it is zero then defaults to an hour ago.
+	Inception time.Time
+
+	// Expiration of signatures, if it is zero then defaults to
+	// DefaultSignatureValidity after Inception.
+	Expiration time.Time
+}
+
+// Sign signs the zone of the origin within the class, and returns the signed
+// zone in canonical order led by the SOA, which could be written by WriteZone.
+// NSEC and RRSIG records of the zone are replaced, and DNSKEY records of keys
+// are added into the zone apex if missing. The SOA serial is not changed.
+func (s *ZoneSigner) Sign(r *Router, origin string, qclass uint16) ([]dns.RR, error) {
+	if len(s.Keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	inception := s.Inception
+	if inception.IsZero() {
+		inception = time.Now().Add(-time.Hour)
+	}
+	expiration := s.Expiration
+	if expiration.IsZero() {
+		expiration = inception.Add(DefaultSignatureValidity)
+	}
+
+	origin = strings.ToLower(dns.Fqdn(origin))
+
+	var signed []dns.RR
+	err := r.update(func(t *txn) error {
+		rrs := treeZone(t.trees[qclass], origin)
+		if rrs == nil {
+			return ErrNoZone
+		}
+		soa := rrs[0].(*dns.SOA)
+
+		// removes previous NSEC chain and signatures
+		names := make(map[string]bool)
+		for _, rr := range rrs {
+			if qtype := rr.Header().Rrtype; qtype == dns.TypeRRSIG || qtype == dns.TypeNSEC {
+				names[rr.Header().Name] = true
+			}
+		}
+		for name := range names {
+			t.remove(name, qclass, func(h typeHandler) bool {
+				_, ok := h.Handler.(Answer)
+				return ok && (h.Qtype == dns.TypeRRSIG || h.Qtype == dns.TypeNSEC) &&
+					(h.Origin == "" || equalName(h.Origin, origin))
+			})
+		}
+
+		for _, key := range s.Keys {
+			var exists bool
+			for _, rr := range rrs {
+				if equalRecord(rr, key.DNSKEY) {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				if err := t.tryHandle(origin, qclass, newTypeHandler(origin, key.DNSKEY, nil)); err != nil {
+					return err
+				}
+			}
+		}
+
+		generated, err := s.sign(treeZone(t.trees[qclass], origin), origin, soa.Minttl, inception, expiration)
+		if err != nil {
+			return err
+		}
+		for _, rr := range generated {
+			if err := t.tryHandle(rr.Header().Name, qclass, newTypeHandler(origin, rr, nil)); err != nil {
+				return err
+			}
+		}
+
+		signed = treeZone(t.trees[qclass], origin)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+// sign returns the NSEC chain and signatures of records in canonical order.
+func (s *ZoneSigner) sign(rrs []dns.RR, origin string, nsecTTL uint32, inception, expiration time.Time) ([]dns.RR, error) {
+	type owner struct {
+		name       string
+		delegation bool
+		rrsets     [][]dns.RR
+	}
+
+	var (
+		owners []*owner
+		cut    string
+	)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if cut != "" && dns.IsSubDomain(cut, hdr.Name) && !equalName(cut, hdr.Name) {
+			// glue is neither signed nor chained
+			continue
+		}
+
+		var o *owner
+		if n := len(owners); n > 0 && equalName(owners[n-1].name, hdr.Name) {
+			o = owners[n-1]
+		} else {
+			o = &owner{name: hdr.Name}
+			owners = append(owners, o)
+		}
+		if hdr.Rrtype == dns.TypeNS && !equalName(hdr.Name, origin) {
+			o.delegation = true
+			cut = hdr.Name
+		}
+
+		if n := len(o.rrsets); n > 0 && o.rrsets[n-1][0].Header().Rrtype == hdr.Rrtype {
+			o.rrsets[n-1] = append(o.rrsets[n-1], rr)
+		} else {
+			o.rrsets = append(o.rrsets, []dns.RR{rr})
+		}
+	}
+
+	var generated []dns.RR
+	for i, o := range owners {
+		nsec := new(dns.NSEC)
+		nsec.Hdr = dns.RR_Header{Name: o.name, Rrtype: dns.TypeNSEC, Class: o.rrsets[0][0].Header().Class, Ttl: nsecTTL}
+		nsec.NextDomain = owners[(i+1)%len(owners)].name
+		nsec.TypeBitMap = []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+		for _, rrset := range o.rrsets {
+			nsec.TypeBitMap = append(nsec.TypeBitMap, rrset[0].Header().Rrtype)
+		}
+		sort.Slice(nsec.TypeBitMap, func(i, j int) bool {
+			return nsec.TypeBitMap[i] < nsec.TypeBitMap[j]
+		})
+		generated = append(generated, nsec)
+
+		for _, rrset := range append(o.rrsets, []dns.RR{nsec}) {
+			qtype := rrset[0].Header().Rrtype
+			if o.delegation && qtype != dns.TypeDS && qtype != dns.TypeNSEC {
+				continue
+			}
+
+			for _, key := range selectKeys(s.Keys, qtype == dns.TypeDNSKEY) {
+				sig, err := signRRset(rrset, origin, key, inception, expiration)
+				if err != nil {
+					return nil, err
+				}
+				generated = append(generated, sig)
+			}
+		}
+	}
+	return generated, nil
+}
@@ -0,0 +1,143 @@
+package dnsrouter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneSigner(t *testing.T) {
+	ksk, kskPrivate := newTestKey(t, "example.org.", dns.ZONE|dns.SEP)
+	zsk, zskPrivate := newTestKey(t, "example.org.", dns.ZONE)
+
+	router := New()
+	router.HandleZone(strings.NewReader(newTestZone("example.org.", 1,
+		"@ 3600 IN NS ns",
+		"ns 3600 IN A 127.0.0.1",
+		"a 3600 IN A 127.0.0.2",
+		"a 3600 IN TXT hello",
+		"*.w 3600 IN A 127.0.0.3",
+		"sub 3600 IN NS ns.sub",
+		"sub 3600 IN DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118",
+		"ns.sub 3600 IN A 127.0.0.4",
+	)), "example.org.", "stdin")
+
+	if _, err := new(ZoneSigner).Sign(router, "example.org.", dns.ClassINET); err != ErrNoKeys {
+		t.Fatalf("expected ErrNoKeys, got %v", err)
+	}
+
+	signer := &ZoneSigner{Keys: []SigningKey{{ksk, kskPrivate}, {zsk, zskPrivate}}}
+	if _, err := signer.Sign(router, "example.com.", dns.ClassINET); err != ErrNoZone {
+		t.Fatalf("expected ErrNoZone, got %v", err)
+	}
+
+	signed, err := signer.Sign(router, "Example.Org", dns.ClassINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("expected SOA first, got %v", signed[0])
+	}
+
+	type rrsetKey struct {
+		name  string
+		qtype uint16
+	}
+	rrsets := make(map[rrsetKey][]dns.RR)
+	var sigs []*dns.RRSIG
+	var nsecs []string
+	for _, rr := range signed {
+		hdr := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			nsecs = append(nsecs, nsec.Hdr.Name+" "+nsec.NextDomain)
+		}
+		k := rrsetKey{hdr.Name, hdr.Rrtype}
+		rrsets[k] = append(rrsets[k], rr)
+	}
+
+	expectedNsecs := []string{
+		"example.org. a.example.org.",
+		"a.example.org. ns.example.org.",
+		"ns.example.org. sub.example.org.",
+		"sub.example.org. *.w.example.org.",
+		"*.w.example.org. example.org.",
+	}
+	if strings.Join(nsecs, "\n") != strings.Join(expectedNsecs, "\n") {
+		t.Errorf("unexpected NSEC chain:\n%s", strings.Join(nsecs, "\n"))
+	}
+
+	for _, sig := range sigs {
+		k := rrsetKey{sig.Hdr.Name, sig.TypeCovered}
+		rrset := rrsets[k]
+		if rrset == nil {
+			t.Errorf("unexpected signature: %v", sig)
+			continue
+		}
+		key := zsk
+		if sig.TypeCovered == dns.TypeDNSKEY {
+			key = ksk
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			t.Errorf("failed to verify %v: %v", sig, err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("invalid validity period: %v", sig)
+		}
+		delete(rrsets, k)
+	}
+	for k := range rrsets {
+		if k.name == "sub.example.org." && k.qtype == dns.TypeNS || k.name == "ns.sub.example.org." {
+			// delegation and glue are not signed
+			continue
+		}
+		t.Errorf("missing signature of %s %s", k.name, dns.TypeToString[k.qtype])
+	}
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		req := NewRequest(qname, qtype)
+		req.SetEdns0(4096, true)
+		w := NewResponseWriter()
+		router.ServeDNS(w, req)
+		return w.Msg()
+	}
+
+	m := query("a.example.org.", dns.TypeA)
+	if len(m.Answer) != 2 || !Exists(m.Answer, dns.TypeRRSIG) {
+		t.Errorf("unexpected answer: %v", m.Answer)
+	}
+	m = query("b.example.org.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || !Exists(m.Ns, dns.TypeNSEC) {
+		t.Errorf("unexpected response: %v", m)
+	}
+
+	// re-signing replaces the previous NSEC chain and signatures
+	resigned, err := signer.Sign(router, "example.org.", dns.ClassINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resigned) != len(signed) {
+		t.Errorf("expected %d records, got %d", len(signed), len(resigned))
+	}
+
+	var buf bytes.Buffer
+	if err := WriteZone(&buf, resigned); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "$ORIGIN example.org.\n") {
+		t.Errorf("unexpected written zone:\n%s", buf.String())
+	}
+	rrs, err := parseZone(&buf, "", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := sortedStrings(rrs), sortedStrings(resigned); strings.Join(a, "\n") != strings.Join(b, "\n") {
+		t.Errorf("unexpected written zone:\n%s", strings.Join(a, "\n"))
+	}
+}